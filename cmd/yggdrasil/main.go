@@ -7,6 +7,7 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/signal"
 	"strings"
@@ -20,6 +21,7 @@ import (
 	"github.com/kardianos/minwinsvc"
 	"github.com/mitchellh/mapstructure"
 
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
 	"github.com/yggdrasil-network/yggdrasil-go/src/admin"
 	"github.com/yggdrasil-network/yggdrasil-go/src/config"
 	"github.com/yggdrasil-network/yggdrasil-go/src/crypto"
@@ -298,6 +300,23 @@ func (n *node) shutdown() {
 	os.Exit(0)
 }
 
+// Returns true if the given address or subnet is in any of the given ranges,
+// which are in CIDR notation. Ranges that can't be parsed are ignored.
+func inSubnets(addr *address.Address, subnet *address.Subnet, cidrs []string) bool {
+	subnetIP := make(net.IP, net.IPv6len)
+	copy(subnetIP, subnet[:])
+	for _, c := range cidrs {
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			continue
+		}
+		if ipnet.Contains(addr[:]) || ipnet.Contains(subnetIP) {
+			return true
+		}
+	}
+	return false
+}
+
 func (n *node) sessionFirewall(pubkey *crypto.BoxPubKey, initiator bool) bool {
 	n.state.Mutex.RLock()
 	defer n.state.Mutex.RUnlock()
@@ -309,6 +328,10 @@ func (n *node) sessionFirewall(pubkey *crypto.BoxPubKey, initiator bool) bool {
 
 	// Prepare for checking whitelist/blacklist
 	var box crypto.BoxPubKey
+	nodeID := crypto.GetNodeID(pubkey)
+	addr := address.AddrForNodeID(nodeID)
+	subnet := address.SubnetForNodeID(nodeID)
+
 	// Reject blacklisted nodes
 	for _, b := range n.state.Current.SessionFirewall.BlacklistEncryptionPublicKeys {
 		key, err := hex.DecodeString(b)
@@ -320,6 +343,11 @@ func (n *node) sessionFirewall(pubkey *crypto.BoxPubKey, initiator bool) bool {
 		}
 	}
 
+	// Reject nodes in blacklisted ranges, even if they are also whitelisted
+	if inSubnets(addr, subnet, n.state.Current.SessionFirewall.BlacklistSubnets) {
+		return false
+	}
+
 	// Allow whitelisted nodes
 	for _, b := range n.state.Current.SessionFirewall.WhitelistEncryptionPublicKeys {
 		key, err := hex.DecodeString(b)
@@ -331,6 +359,11 @@ func (n *node) sessionFirewall(pubkey *crypto.BoxPubKey, initiator bool) bool {
 		}
 	}
 
+	// Allow nodes in whitelisted ranges
+	if inSubnets(addr, subnet, n.state.Current.SessionFirewall.WhitelistSubnets) {
+		return true
+	}
+
 	// Allow outbound sessions if appropriate
 	if n.state.Current.SessionFirewall.AlwaysAllowOutbound {
 		if initiator {
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+)
+
+func TestInSubnets(t *testing.T) {
+	var addr address.Address
+	var subnet address.Subnet
+	copy(addr[:], net.ParseIP("200:1234:5678::1"))
+	copy(subnet[:], net.ParseIP("300:1234:5678:9abc::"))
+	tests := []struct {
+		name     string
+		cidrs    []string
+		expected bool
+	}{
+		{"none", nil, false},
+		{"address", []string{"200:1234::/32"}, true},
+		{"exact address", []string{"200:1234:5678::1/128"}, true},
+		{"subnet", []string{"300:1234:5678:9abc::/64"}, true},
+		{"all nodes", []string{"200::/7"}, true},
+		{"other range", []string{"200:4321::/32", "300:4321::/32"}, false},
+		{"second range", []string{"200:4321::/32", "300:1234::/32"}, true},
+		{"invalid range ignored", []string{"not a range", "200:1234::/32"}, true},
+		{"IPv4", []string{"10.0.0.0/8"}, false},
+	}
+	for _, test := range tests {
+		if got := inSubnets(&addr, &subnet, test.cidrs); got != test.expected {
+			t.Errorf("%s: got %v, expected %v", test.name, got, test.expected)
+		}
+	}
+}
@@ -149,9 +149,9 @@ func (a *AdminSocket) Init(c *yggdrasil.Core, state *config.NodeState, log *log.
 		}
 		return Info{"dht": dht}, nil
 	})
-	a.AddHandler("getSessions", []string{}, func(in Info) (Info, error) {
+	getSessions := func(ss []yggdrasil.Session) Info {
 		sessions := make(Info)
-		for _, s := range a.core.GetSessions() {
+		for _, s := range ss {
 			addr := *address.AddrForNodeID(crypto.GetNodeID(&s.PublicKey))
 			so := net.IP(addr[:]).String()
 			sessions[so] = Info{
@@ -164,8 +164,168 @@ func (a *AdminSocket) Init(c *yggdrasil.Core, state *config.NodeState, log *log.
 				"box_pub_key":   hex.EncodeToString(s.PublicKey[:]),
 			}
 		}
+		return sessions
+	}
+	a.AddHandler("getSessions", []string{}, func(in Info) (Info, error) {
+		return Info{"sessions": getSessions(a.core.GetSessions())}, nil
+	})
+	a.AddHandler("getSessionStats", []string{}, func(in Info) (Info, error) {
+		sessions := make(Info)
+		for _, s := range a.core.GetSessionStats() {
+			so := net.IP(s.Address[:]).String()
+			sessions[so] = Info{
+				"bytes_sent":         s.BytesSent,
+				"bytes_recvd":        s.BytesRecvd,
+				"uptime":             s.Uptime.Seconds(),
+				"last_seen":          s.LastPacket.Seconds(),
+				"latency":            s.Latency.Seconds(),
+				"stale_key_accepted": s.StaleKeyAccepted,
+				"stale_key_dropped":  s.StaleKeyDropped,
+				"future_pings":       s.FuturePings,
+				"replayed_pings":     s.ReplayedPings,
+				"handle_collisions":  s.HandleCollisions,
+				"last_rejected_ping": s.LastRejectedPing,
+				"recv_packet_limit":  s.RecvPacketLimit,
+				"recv_packet_rate":   s.RecvPacketRate,
+				"rate_limited":       s.RateLimited,
+				"invalid_nonce":      s.InvalidNonce,
+				"decrypt_failed":     s.DecryptFailed,
+				"reordered":          s.Reordered,
+				"one_way":            s.OneWay,
+				"box_pub_key":        hex.EncodeToString(s.PublicKey[:]),
+			}
+		}
 		return Info{"sessions": sessions}, nil
 	})
+	a.AddHandler("getUnresponsiveSessions", []string{"[threshold]"}, func(in Info) (Info, error) {
+		// Threshold is in seconds, defaulting to the session keep-alive interval
+		threshold := 6 * time.Second
+		if t, ok := in["threshold"].(float64); ok {
+			threshold = time.Duration(t * float64(time.Second))
+		}
+		return Info{"sessions": getSessions(a.core.GetUnresponsiveSessions(threshold))}, nil
+	})
+	a.AddHandler("getSessionEstablishment", []string{}, func(in Info) (Info, error) {
+		e := a.core.GetSessionEstablishment()
+		return Info{
+			"succeeded":         e.Succeeded,
+			"failed":            e.Failed,
+			"success_rate":      e.SuccessRate,
+			"window":            e.Window.Seconds(),
+			"half_open":         e.HalfOpen,
+			"half_open_refused": e.HalfOpenRefused,
+		}, nil
+	})
+	a.AddHandler("getNodeTrafficStats", []string{}, func(in Info) (Info, error) {
+		t := a.core.GetNodeTrafficStats()
+		drops := Info{}
+		for reason, count := range t.Drops {
+			drops[reason] = count
+		}
+		return Info{
+			"sessions":    t.Sessions,
+			"bytes_sent":  t.BytesSent,
+			"bytes_recvd": t.BytesRecvd,
+			"drops":       drops,
+			"send_rate":   t.SendRate,
+			"recv_rate":   t.RecvRate,
+			"callbacks":   t.Callbacks,
+		}, nil
+	})
+	a.AddHandler("getSessionFeatures", []string{"box_pub_key"}, func(in Info) (Info, error) {
+		var boxPubKey crypto.BoxPubKey
+		if b, err := hex.DecodeString(in["box_pub_key"].(string)); err == nil {
+			copy(boxPubKey[:], b[:])
+		} else {
+			return Info{}, err
+		}
+		features, err := a.core.GetSessionFeatures(boxPubKey)
+		if err != nil {
+			return Info{}, err
+		}
+		return Info{"features": features}, nil
+	})
+	a.AddHandler("setSessionFeature", []string{"box_pub_key", "feature", "enabled"}, func(in Info) (Info, error) {
+		var boxPubKey crypto.BoxPubKey
+		if b, err := hex.DecodeString(in["box_pub_key"].(string)); err == nil {
+			copy(boxPubKey[:], b[:])
+		} else {
+			return Info{}, err
+		}
+		enabled := false
+		if e, ok := in["enabled"].(bool); ok {
+			enabled = e
+		}
+		feature := in["feature"].(string)
+		if err := a.core.SetSessionFeature(boxPubKey, feature, enabled); err != nil {
+			return Info{}, err
+		}
+		return Info{"feature": feature, "enabled": enabled}, nil
+	})
+	a.AddHandler("setSessionMTU", []string{"box_pub_key", "mtu"}, func(in Info) (Info, error) {
+		var boxPubKey crypto.BoxPubKey
+		if b, err := hex.DecodeString(in["box_pub_key"].(string)); err == nil {
+			copy(boxPubKey[:], b[:])
+		} else {
+			return Info{}, err
+		}
+		mtu, ok := in["mtu"].(float64)
+		if !ok || mtu <= 0 || mtu > 65535 {
+			// Anything else doesn't fit in a uint16, and would wrap around
+			return Info{}, errors.New("invalid MTU")
+		}
+		if err := a.core.SetSessionMTU(boxPubKey, uint16(mtu)); err != nil {
+			return Info{}, err
+		}
+		return Info{"mtu": uint16(mtu)}, nil
+	})
+	a.AddHandler("clearSessionMTU", []string{"box_pub_key"}, func(in Info) (Info, error) {
+		var boxPubKey crypto.BoxPubKey
+		if b, err := hex.DecodeString(in["box_pub_key"].(string)); err == nil {
+			copy(boxPubKey[:], b[:])
+		} else {
+			return Info{}, err
+		}
+		a.core.ClearSessionMTU(boxPubKey)
+		return Info{"cleared": in["box_pub_key"].(string)}, nil
+	})
+	a.AddHandler("removeSession", []string{"box_pub_key"}, func(in Info) (Info, error) {
+		var boxPubKey crypto.BoxPubKey
+		if b, err := hex.DecodeString(in["box_pub_key"].(string)); err == nil {
+			copy(boxPubKey[:], b[:])
+		} else {
+			return Info{}, err
+		}
+		if a.core.RemoveSession(boxPubKey) {
+			return Info{
+				"removed": []string{
+					in["box_pub_key"].(string),
+				},
+			}, nil
+		} else {
+			return Info{
+				"not_removed": []string{
+					in["box_pub_key"].(string),
+				},
+			}, errors.New("No session with that key")
+		}
+	})
+	a.AddHandler("flushSharedKeyCache", []string{}, func(in Info) (Info, error) {
+		return Info{"flushed": a.core.FlushSharedKeyCache()}, nil
+	})
+	a.AddHandler("getSessionsFrozen", []string{}, func(in Info) (Info, error) {
+		frozen, refused := a.core.GetSessionsFrozen()
+		return Info{"frozen": frozen, "refused": refused}, nil
+	})
+	a.AddHandler("setSessionsFrozen", []string{"frozen"}, func(in Info) (Info, error) {
+		frozen := false
+		if f, ok := in["frozen"].(bool); ok {
+			frozen = f
+		}
+		a.core.SetSessionsFrozen(frozen)
+		_, refused := a.core.GetSessionsFrozen()
+		return Info{"frozen": frozen, "refused": refused}, nil
+	})
 	a.AddHandler("addPeer", []string{"uri", "[interface]"}, func(in Info) (Info, error) {
 		// Set sane defaults
 		intf := ""
@@ -58,6 +58,7 @@ type NodeConfig struct {
 	SessionFirewall             SessionFirewall        `comment:"The session firewall controls who can send/receive network traffic\nto/from. This is useful if you want to protect this node without\nresorting to using a real firewall. This does not affect traffic\nbeing routed via this node to somewhere else. Rules are prioritised as\nfollows: blacklist, whitelist, always allow outgoing, direct, remote."`
 	TunnelRouting               TunnelRouting          `comment:"Allow tunneling non-Yggdrasil traffic over Yggdrasil. This effectively\nallows you to use Yggdrasil to route to, or to bridge other networks,\nsimilar to a VPN tunnel. Tunnelling works between any two nodes and\ndoes not require them to be directly peered."`
 	SwitchOptions               SwitchOptions          `comment:"Advanced options for tuning the switch. Normally you will not need\nto edit these options."`
+	SessionOptions              SessionOptions         `comment:"Advanced options for tuning sessions. Normally you will not need\nto edit these options."`
 	NodeInfoPrivacy             bool                   `comment:"By default, nodeinfo contains some defaults including the platform,\narchitecture and Yggdrasil version. These can help when surveying\nthe network and diagnosing network routing problems. Enabling\nnodeinfo privacy prevents this, so that only items specified in\n\"NodeInfo\" are sent back if specified."`
 	NodeInfo                    map[string]interface{} `comment:"Optional node info. This must be a { \"key\": \"value\", ... } map\nor set as null. This is entirely optional but, if set, is visible\nto the whole network on request."`
 }
@@ -70,6 +71,8 @@ type SessionFirewall struct {
 	AlwaysAllowOutbound           bool     `comment:"Allow outbound network traffic regardless of AllowFromDirect or\nAllowFromRemote. This does allow a remote node to send unsolicited\ntraffic back to you for the length of the session."`
 	WhitelistEncryptionPublicKeys []string `comment:"List of public keys from which network traffic is always accepted,\nregardless of AllowFromDirect or AllowFromRemote."`
 	BlacklistEncryptionPublicKeys []string `comment:"List of public keys from which network traffic is always rejected,\nregardless of the whitelist, AllowFromDirect or AllowFromRemote."`
+	WhitelistSubnets              []string `comment:"List of IPv6 ranges (in CIDR notation, e.g. \"200:1234::/32\") from\nwhich network traffic is always accepted, based on the Yggdrasil\naddress or subnet of the remote node, regardless of AllowFromDirect\nor AllowFromRemote."`
+	BlacklistSubnets              []string `comment:"List of IPv6 ranges (in CIDR notation) from which network traffic\nis always rejected, based on the Yggdrasil address or subnet of the\nremote node, regardless of either whitelist, AllowFromDirect or\nAllowFromRemote."`
 }
 
 // TunnelRouting contains the crypto-key routing tables for tunneling
@@ -86,6 +89,30 @@ type SwitchOptions struct {
 	MaxTotalQueueSize uint64 `comment:"Maximum size of all switch queues combined (in bytes)."`
 }
 
+// SessionOptions contains tuning options for sessions
+type SessionOptions struct {
+	HandshakeTimeout       uint64            `comment:"Maximum time (in seconds) to wait for a new session to complete its\nhandshake with the remote node, including any retries, before giving\nup on it."`
+	HandlePrefix           string            `comment:"Optional hex-encoded prefix (up to 4 bytes) used at the start of\nevery session handle generated by this node, e.g. to partition the\nhandle space between multiple instances. Handles are always 8 bytes\nlong on the wire, so this does not affect compatibility."`
+	NonceWindow            uint64            `comment:"How long (in milliseconds) to remember recently received nonces for,\nso that packets which arrive out-of-order are still accepted. You may\nneed to raise this on links with high latency."`
+	NonceHeapSize          uint64            `comment:"How many recently received nonces to remember per session before\nolder ones start to expire. You may need to raise this on links with\nhigh bandwidth and high latency, where packets are often reordered.\nThis also limits how many received packets can be queued for\ndecryption per session. Values over 4096 are lowered to 4096."`
+	StaleKeyGracePeriod    uint64            `comment:"How long (in milliseconds) to keep accepting packets encrypted with\na remote node's previous session key after it changes, so that\npackets still in flight aren't dropped. Set to 0 to drop them."`
+	KeyRotationInterval    uint64            `comment:"How often (in seconds) to generate new ephemeral keys for each open\nsession, so that a compromised session key only exposes the traffic\nsent since the last rotation. Set to 0 to keep the same keys for the\nlifetime of the session."`
+	KeyRotationBytes       uint64            `comment:"How much traffic (in bytes) each session can send before generating\nnew ephemeral keys, in addition to KeyRotationInterval, so that busy\nsessions don't protect too much traffic with the same keys. Keys are\nrotated at most once per second. Set to 0 to only rotate keys based\non time."`
+	IdleTimeout            uint64            `comment:"How long (in seconds) a session can go without receiving any traffic\nor session pings from the remote node before it is closed. Sessions\nare kept alive by pings while they are in use. Set to 0 to never close\nidle sessions."`
+	MaxSessions            uint64            `comment:"Maximum number of sessions which can be open at once. When there are\nthis many, sessions opened by remote nodes are refused, and opening a\nsession ourselves closes the least recently used session that was\nopened by a remote node, if there is one. Set to 0 for no limit."`
+	MaxHalfOpen            uint64            `comment:"Maximum number of sessions which can be waiting to finish their\nhandshake at once. New sessions are refused while there are this many,\nso that floods of unresponsive nodes can't use up resources. Set to 0\nfor no limit."`
+	MaxMTU                 uint64            `comment:"Largest MTU (in bytes) that sessions will use, even if IfMTU at both\nends is higher, e.g. if jumbo packets are dropped somewhere along the\npath. Set to 0 to only be limited by IfMTU at both ends. Values lower\nthan 1280 are treated as 1280."`
+	MaxPingSkew            uint64            `comment:"How far (in seconds) the timestamp in a session ping is allowed to be\nahead of our own clock. Pings from further in the future are rejected,\nas accepting them would cause the remote node's later pings to be\nrejected until our clock catches up. Set to 0 to allow any timestamp."`
+	SendRateLimit          uint64            `comment:"Maximum rate (in bytes per second) at which each session can send\ntraffic, to stop a single session from using all of a slow uplink.\nTraffic over the limit is delayed, not dropped. Set to 0 for no limit."`
+	SendRateBurst          uint64            `comment:"How many bytes (at most) each session can send in a single burst\nwithout being delayed by SendRateLimit. Set to 0 to allow one\nsecond's worth of traffic at the limit."`
+	SendRateLimitOverrides map[string]uint64 `comment:"Per-node send rate limits (in bytes per second) which are used\ninstead of SendRateLimit, e.g. { \"boxpubkey\": 1000000, ... }. Set a\nnode's limit to 0 to exempt it from SendRateLimit."`
+	RecvPacketLimit        uint64            `comment:"Maximum rate (in packets per second) at which each session accepts\ntraffic from the remote node, to protect against floods of small\npackets. Packets over the limit are dropped before being decrypted.\nSet to 0 for no limit."`
+	Compression            bool              `comment:"Compress session traffic before encrypting it, which can save\nbandwidth for compressible traffic at the cost of some CPU. Only used\nwith remote nodes that have it enabled too. Changing this generates\nnew session keys for sessions which are already open."`
+	RecvBufferSize         uint64            `comment:"How many received packets can be queued per session waiting to be\nread, up to 65536. Lower values reduce latency, higher values can\nimprove throughput for bulk transfers. Set to 0 to use the default of\n32. Changes only apply to new sessions, not ones which are already open."`
+	SendBufferSize         uint64            `comment:"How many packets can be queued per session waiting to be sent, up\nto 65536. Lower values reduce latency, higher values can improve\nthroughput for bulk transfers. Set to 0 to use the default of 32.\nChanges only apply to new sessions, not ones which are already open."`
+	TimestampStore         string            `comment:"Optional path to a file in which to keep the timestamp of the last\nsession ping received from each node, so that old pings can't be\nreplayed to us after a restart. The file is written at most once a\nminute and when the node stops, and only the newest 4096 are kept.\nLeave empty to not keep timestamps."`
+}
+
 // Generates default configuration. This is used when outputting the -genconf
 // parameter and also when using -autoconf. The isAutoconf flag is used to
 // determine whether the operating system should select a free port by itself
@@ -117,6 +144,13 @@ func GenerateConfig() *NodeConfig {
 	cfg.SessionFirewall.AllowFromRemote = true
 	cfg.SessionFirewall.AlwaysAllowOutbound = true
 	cfg.SwitchOptions.MaxTotalQueueSize = 4 * 1024 * 1024
+	cfg.SessionOptions.HandshakeTimeout = 6
+	cfg.SessionOptions.NonceWindow = 1000
+	cfg.SessionOptions.NonceHeapSize = 64
+	cfg.SessionOptions.MaxPingSkew = 60
+	cfg.SessionOptions.RecvBufferSize = 32
+	cfg.SessionOptions.SendBufferSize = 32
+	cfg.SessionOptions.SendRateLimitOverrides = map[string]uint64{}
 	cfg.NodeInfoPrivacy = false
 
 	return &cfg
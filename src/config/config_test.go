@@ -0,0 +1,36 @@
+package config
+
+import "testing"
+
+func TestGenerateConfigSessionOptions(t *testing.T) {
+	options := GenerateConfig().SessionOptions
+	tests := []struct {
+		name     string
+		value    uint64
+		expected uint64
+	}{
+		{"HandshakeTimeout", options.HandshakeTimeout, 6},
+		{"NonceWindow", options.NonceWindow, 1000},
+		{"NonceHeapSize", options.NonceHeapSize, 64},
+		{"StaleKeyGracePeriod", options.StaleKeyGracePeriod, 0},
+		{"KeyRotationInterval", options.KeyRotationInterval, 0},
+		{"KeyRotationBytes", options.KeyRotationBytes, 0},
+		{"IdleTimeout", options.IdleTimeout, 0},
+		{"MaxSessions", options.MaxSessions, 0},
+		{"MaxHalfOpen", options.MaxHalfOpen, 0},
+		{"MaxMTU", options.MaxMTU, 0},
+		{"MaxPingSkew", options.MaxPingSkew, 60},
+		{"SendRateLimit", options.SendRateLimit, 0},
+		{"RecvPacketLimit", options.RecvPacketLimit, 0},
+		{"RecvBufferSize", options.RecvBufferSize, 32},
+		{"SendBufferSize", options.SendBufferSize, 32},
+	}
+	for _, test := range tests {
+		if test.value != test.expected {
+			t.Errorf("%s: got %d, expected %d", test.name, test.value, test.expected)
+		}
+	}
+	if options.SendRateLimitOverrides == nil {
+		t.Error("SendRateLimitOverrides is nil, so it won't be shown as a map in generated configs")
+	}
+}
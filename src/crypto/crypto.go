@@ -88,6 +88,22 @@ func NewHandle() *Handle {
 	return &h
 }
 
+// The longest prefix that NewHandleWithPrefix will use, so that every handle
+// still has at least 32 random bits.
+const MaxHandlePrefixLen = handleLen - 4
+
+// NewHandleWithPrefix generates a random handle which starts with the given
+// prefix, which can be used to partition the handle space between multiple
+// instances. Prefixes longer than MaxHandlePrefixLen are truncated.
+func NewHandleWithPrefix(prefix []byte) *Handle {
+	h := NewHandle()
+	if len(prefix) > MaxHandlePrefixLen {
+		prefix = prefix[:MaxHandlePrefixLen]
+	}
+	copy(h[:], prefix)
+	return h
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 // Signatures
@@ -214,6 +230,14 @@ func (n *BoxNonce) Increment() {
 	}
 }
 
+// NearMax returns true if the nonce is getting close to the top of its range,
+// in which case the keys it is used with should be replaced before the nonce
+// can wrap around and be reused. This is the same limit that NewBoxNonce uses
+// to avoid starting too high.
+func (n *BoxNonce) NearMax() bool {
+	return n[0] == 0xff
+}
+
 func (p BoxPrivKey) Public() BoxPubKey {
 	var boxPub [BoxPubKeyLen]byte
 	var boxPriv [BoxPrivKeyLen]byte
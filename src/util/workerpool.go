@@ -27,3 +27,16 @@ func init() {
 func WorkerGo(f func()) {
 	workerPool <- f
 }
+
+// TryWorkerGo submits a job to the worker pool in the same way as WorkerGo, but
+// never blocks. It returns false if the pool was not able to accept the job,
+// e.g. because all of the workers are busy, in which case the caller is
+// responsible for running f() some other way (such as inline).
+func TryWorkerGo(f func()) bool {
+	select {
+	case workerPool <- f:
+		return true
+	default:
+		return false
+	}
+}
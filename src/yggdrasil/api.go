@@ -91,6 +91,70 @@ type Session struct {
 	WasMTUFixed bool
 }
 
+// SessionStats represents the traffic statistics of an open session with
+// another node.
+type SessionStats struct {
+	PublicKey        crypto.BoxPubKey
+	Address          address.Address
+	BytesSent        uint64
+	BytesRecvd       uint64
+	Uptime           time.Duration // Time since the session was opened
+	LastPacket       time.Duration // Time since a packet was last received
+	Latency          time.Duration // Smoothed round-trip time, or 0 if not yet measured
+	StaleKeyAccepted uint64        // Packets accepted under the previous session key, during the grace window
+	StaleKeyDropped  uint64        // Packets under the previous session key, dropped because the grace window ended while decrypting them
+	FuturePings      uint64        // Session pings rejected for having a timestamp too far in the future
+	ReplayedPings    uint64        // Session pings rejected for not being newer than the last, e.g. replays
+	HandleCollisions uint64        // Handles skipped for being in use when the session was opened, plus session pings rejected for being from another node with the same handle
+	LastRejectedPing string        // Reason the last rejected session ping was rejected, or "" if none were
+	RecvPacketLimit  uint64        // Maximum packets per second accepted from the remote node, or 0 for no limit
+	RecvPacketRate   float64       // Packets per second recently received from the remote node, including any dropped
+	RateLimited      uint64        // Packets dropped for being over RecvPacketLimit
+	InvalidNonce     uint64        // Packets dropped for having a nonce that was too old or already seen
+	DecryptFailed    uint64        // Packets dropped because they couldn't be decrypted
+	Reordered        uint64        // Packets accepted out of order, with an older nonce than one already seen
+	OneWay           bool          // Traffic is being sent, but none has been received for a while
+}
+
+// SessionEstablishment represents the outcomes of recent attempts to establish
+// sessions, either dialed by this node or initiated by remote nodes.
+type SessionEstablishment struct {
+	Succeeded       uint64        // Sessions which finished their handshake
+	Failed          uint64        // Sessions which were refused or timed out
+	SuccessRate     float64       // Ratio of succeeded to all attempts, or 1 if there were none
+	Window          time.Duration // How far back these statistics go
+	HalfOpen        int           // Sessions which haven't finished their handshake yet
+	HalfOpenRefused uint64        // Sessions refused because too many were half-open, since the node started
+}
+
+// NodeTrafficStats represents the traffic statistics of all sessions combined,
+// including sessions which have since closed.
+type NodeTrafficStats struct {
+	Sessions   int               // Number of currently open sessions
+	BytesSent  uint64            // Total bytes of traffic sent in all sessions
+	BytesRecvd uint64            // Total bytes of traffic received in all sessions
+	Drops      map[string]uint64 // Total received packets dropped, by reason
+	SendRate   float64           // Bytes per second sent since the previous call
+	RecvRate   float64           // Bytes per second received since the previous call
+	Callbacks  int               // Packets waiting on encryption or decryption, across all sessions
+}
+
+// SessionEventType is the kind of change described by a SessionEvent.
+type SessionEventType int
+
+const (
+	SessionOpened SessionEventType = iota // The session finished its handshake
+	SessionClosed                         // The session was closed
+)
+
+// SessionEvent describes a session opening or closing, and is sent to any
+// channels registered with SubscribeSessionEvents.
+type SessionEvent struct {
+	Type      SessionEventType
+	PublicKey crypto.BoxPubKey
+	Address   address.Address
+}
+
 // GetPeers returns one or more Peer objects containing information about active
 // peerings with other Yggdrasil nodes, where one of the responses always
 // includes information about the current node (with a port number of 0). If
@@ -208,18 +272,10 @@ func (c *Core) GetSwitchQueues() SwitchQueues {
 func (c *Core) GetSessions() []Session {
 	var sessions []Session
 	getSessions := func() {
-		for _, sinfo := range c.sessions.sinfos {
+		for _, sinfo := range c.sessions.getAll() {
 			var session Session
 			workerFunc := func() {
-				session = Session{
-					Coords:      append([]uint64{}, wire_coordsBytestoUint64s(sinfo.coords)...),
-					MTU:         sinfo.getMTU(),
-					BytesSent:   sinfo.bytesSent,
-					BytesRecvd:  sinfo.bytesRecvd,
-					Uptime:      time.Now().Sub(sinfo.timeOpened),
-					WasMTUFixed: sinfo.wasMTUFixed,
-				}
-				copy(session.PublicKey[:], sinfo.theirPermPub[:])
+				session = sinfo.getSession()
 			}
 			var skip bool
 			func() {
@@ -241,6 +297,249 @@ func (c *Core) GetSessions() []Session {
 	return sessions
 }
 
+// GetSessionStats returns traffic statistics for each open session from this
+// node to other nodes.
+func (c *Core) GetSessionStats() []SessionStats {
+	var stats []SessionStats
+	c.router.doAdmin(func() {
+		stats = c.sessions.getSessionStats()
+	})
+	return stats
+}
+
+// GetUnresponsiveSessions returns a list of open sessions which have been
+// sending session pings without receiving anything back from the remote node,
+// and which haven't received anything for more than the given threshold. These
+// sessions have likely lost connectivity and will probably time out soon.
+func (c *Core) GetUnresponsiveSessions(threshold time.Duration) []Session {
+	var sessions []Session
+	getSessions := func() {
+		for _, sinfo := range c.sessions.getUnresponsive(threshold) {
+			var session Session
+			sinfo.doFunc(func() {
+				session = sinfo.getSession()
+			})
+			sessions = append(sessions, session)
+		}
+	}
+	c.router.doAdmin(getSessions)
+	return sessions
+}
+
+// SetSessionFeature enables or disables an optional feature on the open
+// session with the given public key, either "strict_ordering" or "trace_ids".
+// This only affects the one session, and the setting is lost when the session
+// closes. Turning trace IDs on or off takes effect once the session has
+// generated new keys, which it does straight away.
+func (c *Core) SetSessionFeature(key crypto.BoxPubKey, name string, enabled bool) error {
+	if !isSessionFeature(name) {
+		return fmt.Errorf("unknown session feature: %s", name)
+	}
+	var err error
+	c.router.doAdmin(func() {
+		sinfo, isIn := c.sessions.getByTheirPerm(&key)
+		if !isIn {
+			err = errors.New("no session found for the given key")
+			return
+		}
+		sinfo.doFunc(func() {
+			sinfo.features[name] = enabled
+			if name == sessionFeatureTraceIDs && enabled != sinfo.myTraceIDs {
+				sinfo.requestRotate()
+			}
+		})
+	})
+	return err
+}
+
+// GetSessionFeatures returns the optional features that have been set on the
+// open session with the given public key.
+func (c *Core) GetSessionFeatures(key crypto.BoxPubKey) (map[string]bool, error) {
+	features := make(map[string]bool)
+	var err error
+	c.router.doAdmin(func() {
+		sinfo, isIn := c.sessions.getByTheirPerm(&key)
+		if !isIn {
+			err = errors.New("no session found for the given key")
+			return
+		}
+		sinfo.doFunc(func() {
+			for name, enabled := range sinfo.features {
+				features[name] = enabled
+			}
+		})
+	})
+	return features, err
+}
+
+// SetSessionMTU sets the MTU that this node advertises to the node with the
+// given public key, instead of IfMTU, e.g. if the path to that node is known
+// to carry a particular packet size. It applies to any open session with the
+// node straight away, to sessions opened with it later and after any coords
+// changes, until ClearSessionMTU is called. The session MTU can still be lower
+// than this if the remote node advertises a lower MTU, or if MaxMTU is set to
+// something lower. The MTU must be at least 1280.
+func (c *Core) SetSessionMTU(key crypto.BoxPubKey, mtu uint16) error {
+	if mtu < minSessionMTU {
+		return fmt.Errorf("MTU must be at least %d", minSessionMTU)
+	}
+	c.router.doAdmin(func() {
+		c.sessions.setMTUPin(&key, mtu)
+	})
+	return nil
+}
+
+// ClearSessionMTU removes an MTU set with SetSessionMTU, so that sessions with
+// the node with the given public key go back to advertising IfMTU.
+func (c *Core) ClearSessionMTU(key crypto.BoxPubKey) {
+	c.router.doAdmin(func() {
+		c.sessions.setMTUPin(&key, 0)
+	})
+}
+
+// GetSessionEstablishment returns the number of recent attempts to establish
+// a session that succeeded or failed, along with the success rate. A declining
+// success rate can indicate network problems or an overly strict session
+// firewall.
+func (c *Core) GetSessionEstablishment() SessionEstablishment {
+	var establishment SessionEstablishment
+	c.router.doAdmin(func() {
+		establishment.Succeeded, establishment.Failed = c.sessions.getEstablishments()
+		establishment.HalfOpen = c.sessions.halfOpen
+		establishment.HalfOpenRefused = c.sessions.halfOpenRefused
+	})
+	establishment.SuccessRate = 1
+	if total := establishment.Succeeded + establishment.Failed; total > 0 {
+		establishment.SuccessRate = float64(establishment.Succeeded) / float64(total)
+	}
+	establishment.Window = establishmentBuckets * time.Minute
+	return establishment
+}
+
+// GetNodeTrafficStats returns the traffic statistics of the node as a whole,
+// summed across every session. The throughput is averaged over the time since
+// the last call to GetNodeTrafficStats, or since the node started.
+func (c *Core) GetNodeTrafficStats() NodeTrafficStats {
+	var stats NodeTrafficStats
+	c.router.doAdmin(func() {
+		stats = c.sessions.getTotals()
+	})
+	return stats
+}
+
+// GetHalfOpenSessions returns the sessions which have been created, either by
+// dialing or by a session ping from a remote node, but which haven't finished
+// their handshake yet. These sessions can't carry any traffic.
+func (c *Core) GetHalfOpenSessions() []Session {
+	var sessions []Session
+	c.router.doAdmin(func() {
+		for _, sinfo := range c.sessions.getHalfOpen() {
+			sinfo.doFunc(func() {
+				sessions = append(sessions, sinfo.getSession())
+			})
+		}
+	})
+	return sessions
+}
+
+// GetSessionByAddress returns the open session with the node that has the
+// given address, if there is one.
+func (c *Core) GetSessionByAddress(addr address.Address) (session Session, isIn bool) {
+	c.router.doAdmin(func() {
+		var sinfo *sessionInfo
+		if sinfo, isIn = c.sessions.getByAddress(&addr); isIn {
+			sinfo.doFunc(func() { session = sinfo.getSession() })
+		}
+	})
+	return
+}
+
+// GetSessionBySubnet returns the open session with the node that has the
+// given subnet, if there is one.
+func (c *Core) GetSessionBySubnet(subnet address.Subnet) (session Session, isIn bool) {
+	c.router.doAdmin(func() {
+		var sinfo *sessionInfo
+		if sinfo, isIn = c.sessions.getBySubnet(&subnet); isIn {
+			sinfo.doFunc(func() { session = sinfo.getSession() })
+		}
+	})
+	return
+}
+
+// Builds the public representation of a session. The caller must hold the
+// session mutex.
+func (sinfo *sessionInfo) getSession() Session {
+	session := Session{
+		Coords:      append([]uint64{}, wire_coordsBytestoUint64s(sinfo.coords)...),
+		MTU:         sinfo.getMTU(),
+		BytesSent:   atomic.LoadUint64(&sinfo.bytesSent),
+		BytesRecvd:  atomic.LoadUint64(&sinfo.bytesRecvd),
+		Uptime:      sinfo.core.sessions.now().Sub(sinfo.timeOpened),
+		WasMTUFixed: sinfo.wasMTUFixed,
+	}
+	copy(session.PublicKey[:], sinfo.theirPermPub[:])
+	return session
+}
+
+// FlushSharedKeyCache throws away every cached shared key derived from the
+// permanent keys of remote nodes, e.g. for incident response, so that they
+// must be derived again before they're next used. Session keys are not
+// affected. Returns the number of keys that were flushed.
+func (c *Core) FlushSharedKeyCache() int {
+	return c.sessions.flushPermShared()
+}
+
+// RemoveSession forcibly closes the open session with the node that has the
+// given public key, if there is one. Any Conn using the session will return
+// errors from then on. Returns true if a session was found and closed.
+func (c *Core) RemoveSession(key crypto.BoxPubKey) bool {
+	var removed bool
+	c.router.doAdmin(func() {
+		removed = c.sessions.removeSession(&key)
+	})
+	return removed
+}
+
+// SubscribeSessionEvents registers a channel to be notified whenever a session
+// finishes its handshake or closes. Events are never allowed to block the
+// session code, so if the channel isn't ready to receive then the event is
+// dropped; use a buffered channel and read from it promptly to avoid this.
+func (c *Core) SubscribeSessionEvents(ch chan<- SessionEvent) {
+	c.router.doAdmin(func() {
+		c.sessions.addEventListener(ch)
+	})
+}
+
+// UnsubscribeSessionEvents stops sending session events to a channel that was
+// registered with SubscribeSessionEvents. Once this returns, no more events
+// will be sent to the channel, so it is then safe to close it.
+func (c *Core) UnsubscribeSessionEvents(ch chan<- SessionEvent) {
+	c.router.doAdmin(func() {
+		c.sessions.removeEventListener(ch)
+	})
+}
+
+// SetSessionsFrozen stops (or resumes) the creation of new sessions, both
+// those that we would initiate by dialing and those that remote nodes would
+// initiate by sending us a session ping. Existing sessions are not affected and
+// will continue to pass traffic normally.
+func (c *Core) SetSessionsFrozen(frozen bool) {
+	c.router.doAdmin(func() {
+		c.sessions.isFrozen = frozen
+	})
+}
+
+// GetSessionsFrozen returns true if the creation of new sessions is currently
+// frozen, along with the number of new sessions that have been refused because
+// of it.
+func (c *Core) GetSessionsFrozen() (frozen bool, refused uint64) {
+	c.router.doAdmin(func() {
+		frozen = c.sessions.isFrozen
+		refused = c.sessions.frozenRefused
+	})
+	return
+}
+
 // ConnListen returns a listener for Yggdrasil session connections.
 func (c *Core) ConnListen() (*Listener, error) {
 	c.sessions.listenerMutex.Lock()
@@ -256,6 +555,33 @@ func (c *Core) ConnListen() (*Listener, error) {
 	return c.sessions.listener, nil
 }
 
+// ClearFlowAffinity forgets which node the given flow was connected to by
+// Dialer.DialFlow, so that the next DialFlow can pick any matching node.
+func (c *Core) ClearFlowAffinity(flowKey uint64) {
+	c.router.doAdmin(func() {
+		delete(c.sessions.flowAffinity, flowKey)
+	})
+}
+
+// MaxFlowPriority is the highest priority that can be given to a flow with
+// SetFlowPriority.
+const MaxFlowPriority = numFlowPriorities - 1
+
+// SetFlowPriority sets the priority of a flow, from 0 (the default) up to
+// MaxFlowPriority, for all sessions. When packets from several flows are
+// waiting to be sent in the same session, packets from higher priority flows
+// are sent first, although lower priority flows are never starved completely.
+// Packets within a flow are always sent in order. Setting a flow's priority back
+// to 0 removes it. If no flows have priorities, packets are sent in the order
+// they were written.
+func (c *Core) SetFlowPriority(flowKey uint64, priority int) error {
+	if priority < 0 || priority > MaxFlowPriority {
+		return fmt.Errorf("priority must be between 0 and %d", MaxFlowPriority)
+	}
+	c.sessions.setFlowPriority(flowKey, priority)
+	return nil
+}
+
 // ConnDialer returns a dialer for Yggdrasil session connections.
 func (c *Core) ConnDialer() (*Dialer, error) {
 	return &Dialer{
@@ -362,6 +688,31 @@ func (c *Core) SetSessionGatekeeper(f func(pubkey *crypto.BoxPubKey, initiator b
 	c.sessions.isAllowedHandler = f
 }
 
+// SetSessionAddressGatekeeper works like SetSessionGatekeeper, but the handler
+// function receives the Yggdrasil address and subnet of the remote side instead
+// of its public key, which is useful for rules based on address ranges. If both
+// handlers are set, then a session is only allowed if both of them allow it.
+func (c *Core) SetSessionAddressGatekeeper(f func(addr *address.Address, subnet *address.Subnet, initiator bool) bool) {
+	c.sessions.isAllowedMutex.Lock()
+	defer c.sessions.isAllowedMutex.Unlock()
+
+	c.sessions.isAllowedAddr = f
+}
+
+// SetSessionMTUHandler allows you to configure a handler function which is
+// called whenever the MTU of a session changes, i.e. when the remote side
+// advertises a different MTU or the configured maximum changes. The function
+// receives the Yggdrasil address of the remote side and the new MTU. It is not
+// called when a ping just confirms the MTU that the session already has. The
+// function is called while the session is locked, so it must not block or
+// call back into the session.
+func (c *Core) SetSessionMTUHandler(f func(addr address.Address, mtu uint16)) {
+	c.sessions.mtuHandlerMutex.Lock()
+	defer c.sessions.mtuHandlerMutex.Unlock()
+
+	c.sessions.mtuHandler = f
+}
+
 // SetLogger sets the output logger of the Yggdrasil node after startup. This
 // may be useful if you want to redirect the output later.
 func (c *Core) SetLogger(log *log.Logger) {
@@ -1,6 +1,7 @@
 package yggdrasil
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
@@ -81,7 +82,7 @@ func (c *Conn) String() string {
 }
 
 // This should never be called from the router goroutine, used in the dial functions
-func (c *Conn) search() error {
+func (c *Conn) search(ctx context.Context) error {
 	var sinfo *searchInfo
 	var isIn bool
 	c.core.router.doAdmin(func() { sinfo, isIn = c.core.searches.searches[*c.nodeID] })
@@ -102,7 +103,19 @@ func (c *Conn) search() error {
 			sinfo = c.core.searches.newIterSearch(c.nodeID, c.nodeMask, searchCompleted)
 			sinfo.continueSearch()
 		})
-		<-done
+		select {
+		case <-done:
+		case <-ctx.Done():
+			go func() {
+				// Nobody is waiting for the result any more, so don't leave a
+				// half-open session behind if the search finds one later
+				<-done
+				if sess != nil {
+					sess.cancelIfNotReady(ctx.Err())
+				}
+			}()
+			return ctx.Err()
+		}
 		c.session = sess
 		if c.session == nil && err == nil {
 			panic("search failed but returned no error")
@@ -150,6 +163,21 @@ func (c *Conn) getDeadlineCancellation(value *atomic.Value) (util.Cancellation,
 
 // Used internally by Read, the caller is responsible for util.PutBytes when they're done.
 func (c *Conn) ReadNoCopy() ([]byte, error) {
+	msg, err := c.readMessage()
+	return msg.message, err
+}
+
+// Returns the error used when a read or write fails because the session has
+// been closed, including the reason the session was closed for, if known.
+func closedError(cancel util.Cancellation) error {
+	if reason := cancel.Error(); reason != nil {
+		return ConnError{fmt.Errorf("session closed: %v", reason), false, false, true, 0}
+	}
+	return ConnError{errors.New("session closed"), false, false, true, 0}
+}
+
+// Used internally by ReadNoCopy and ReadWithTraceID, waits for the next packet.
+func (c *Conn) readMessage() (recvMessage, error) {
 	cancel, doCancel := c.getDeadlineCancellation(&c.readDeadline)
 	if doCancel {
 		defer cancel.Cancel(nil)
@@ -158,21 +186,30 @@ func (c *Conn) ReadNoCopy() ([]byte, error) {
 	select {
 	case <-cancel.Finished():
 		if cancel.Error() == util.CancellationTimeoutError {
-			return nil, ConnError{errors.New("read timeout"), true, false, false, 0}
+			return recvMessage{}, ConnError{errors.New("read timeout"), true, false, false, 0}
 		} else {
-			return nil, ConnError{errors.New("session closed"), false, false, true, 0}
+			return recvMessage{}, closedError(cancel)
 		}
-	case bs := <-c.session.recv:
-		return bs, nil
+	case msg := <-c.session.recv:
+		return msg, nil
 	}
 }
 
 // Implements net.Conn.Read
 func (c *Conn) Read(b []byte) (int, error) {
-	bs, err := c.ReadNoCopy()
+	n, _, err := c.ReadWithTraceID(b)
+	return n, err
+}
+
+// ReadWithTraceID works like Read, but also returns the trace ID that the
+// remote node attached to the packet, or 0 if there wasn't one. Trace IDs are
+// only carried if the remote node has the "trace_ids" feature enabled.
+func (c *Conn) ReadWithTraceID(b []byte) (int, uint64, error) {
+	msg, err := c.readMessage()
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
+	bs := msg.message
 	n := len(bs)
 	if len(bs) > len(b) {
 		n = len(b)
@@ -182,22 +219,69 @@ func (c *Conn) Read(b []byte) (int, error) {
 	copy(b, bs)
 	util.PutBytes(bs)
 	// Return the number of bytes copied to the slice, along with any error
-	return n, err
+	return n, msg.traceID, err
+}
+
+// ReadBatch reads up to len(bufs) packets into bufs, preserving the order in
+// which they were received. It blocks until the first packet is available (or
+// the read deadline passes), but then only takes packets which are already
+// waiting, so it never blocks for more than the first. Each buffer is resliced
+// (up to its capacity) to the length of the packet read into it. Returns the
+// number of buffers that were filled.
+func (c *Conn) ReadBatch(bufs [][]byte) (int, error) {
+	if len(bufs) == 0 {
+		return 0, nil
+	}
+	bs, err := c.ReadNoCopy()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for {
+		copied := copy(bufs[n][:cap(bufs[n])], bs)
+		bufs[n] = bufs[n][:copied]
+		truncated := copied < len(bs)
+		util.PutBytes(bs)
+		n++
+		switch {
+		case truncated:
+			return n, ConnError{errors.New("read buffer too small for entire packet"), false, true, false, 0}
+		case n == len(bufs):
+			return n, nil
+		}
+		select {
+		case msg := <-c.session.recv:
+			bs = msg.message
+		default:
+			// Nothing else is waiting, so return what we have
+			return n, nil
+		}
+	}
 }
 
 // Used internally by Write, the caller must not reuse the argument bytes when no error occurs
 func (c *Conn) WriteNoCopy(msg FlowKeyMessage) error {
+	return c.writeNoCopy(msg, true)
+}
+
+// Used internally by WriteNoCopy and TryWrite. If block is false, then instead
+// of waiting for room in the session's send queue, a temporary error is
+// returned straight away if the queue is full.
+func (c *Conn) writeNoCopy(msg FlowKeyMessage, block bool) error {
 	var err error
 	sessionFunc := func() {
 		// Does the packet exceed the permitted size for the session?
-		if uint16(len(msg.Message)) > c.session.getMTU() {
-			err = ConnError{errors.New("packet too big"), true, false, false, int(c.session.getMTU())}
+		// Leave room for any headers in front of the message
+		mtu := c.session.getMTU() - c.session.headerLen()
+		if uint16(len(msg.Message)) > mtu {
+			err = ConnError{errors.New("packet too big"), true, false, false, int(mtu)}
 			return
 		}
 		// The rest of this work is session keep-alive traffic
+		now := c.core.sessions.now()
 		switch {
-		case time.Since(c.session.time) > 6*time.Second:
-			if c.session.time.Before(c.session.pingTime) && time.Since(c.session.pingTime) > 6*time.Second {
+		case now.Sub(c.session.time) > 6*time.Second:
+			if c.session.time.Before(c.session.pingTime) && now.Sub(c.session.pingTime) > 6*time.Second {
 				// TODO double check that the above condition is correct
 				c.doSearch()
 			} else {
@@ -209,6 +293,16 @@ func (c *Conn) WriteNoCopy(msg FlowKeyMessage) error {
 		}
 	}
 	c.session.doFunc(sessionFunc)
+	if err == nil && !block {
+		select {
+		case <-c.session.cancel.Finished():
+			err = closedError(c.session.cancel)
+		case c.session.send <- msg:
+		default:
+			err = ConnError{errors.New("send queue full"), false, true, false, 0}
+		}
+		return err
+	}
 	if err == nil {
 		cancel, doCancel := c.getDeadlineCancellation(&c.writeDeadline)
 		if doCancel {
@@ -219,7 +313,7 @@ func (c *Conn) WriteNoCopy(msg FlowKeyMessage) error {
 			if cancel.Error() == util.CancellationTimeoutError {
 				err = ConnError{errors.New("write timeout"), true, false, false, 0}
 			} else {
-				err = ConnError{errors.New("session closed"), false, false, true, 0}
+				err = closedError(cancel)
 			}
 		case c.session.send <- msg:
 		}
@@ -229,9 +323,40 @@ func (c *Conn) WriteNoCopy(msg FlowKeyMessage) error {
 
 // Implements net.Conn.Write
 func (c *Conn) Write(b []byte) (int, error) {
+	return c.WriteWithTraceID(b, 0)
+}
+
+// WriteWithTraceID works like Write, but attaches a trace ID to the packet, so
+// that tracing context can be passed through to the remote node. The trace ID
+// is only sent if the session has the "trace_ids" feature enabled, which the
+// remote node is told about, so it can always read it.
+func (c *Conn) WriteWithTraceID(b []byte, traceID uint64) (int, error) {
+	return c.writeMessage(FlowKeyMessage{TraceID: traceID}, b, true)
+}
+
+// WriteWithFlowKey works like Write, but tags the packet with a flow key, e.g.
+// a hash of the 5-tuple of the traffic inside it. Packets with different flow
+// keys are queued separately by the switches along the path, so that a bulk
+// transfer doesn't hold up latency-sensitive traffic to the same node. A flow
+// key of 0 means no flow key, which is the same as calling Write.
+func (c *Conn) WriteWithFlowKey(b []byte, flowKey uint64) (int, error) {
+	return c.writeMessage(FlowKeyMessage{FlowKey: flowKey}, b, true)
+}
+
+// TryWrite works like Write, but never waits for room in the session's send
+// queue, the size of which is set by SessionOptions.SendBufferSize. If the
+// queue is full, then nothing is written and a ConnError is returned straight
+// away, for which Temporary() is true. This lets the caller decide whether to
+// drop the packet, retry later or slow down, instead of being blocked.
+func (c *Conn) TryWrite(b []byte) (int, error) {
+	return c.writeMessage(FlowKeyMessage{}, b, false)
+}
+
+// Used internally by Write and friends, copies b into msg and sends it.
+func (c *Conn) writeMessage(msg FlowKeyMessage, b []byte, block bool) (int, error) {
 	written := len(b)
-	msg := FlowKeyMessage{Message: append(util.GetBytes(), b...)}
-	err := c.WriteNoCopy(msg)
+	msg.Message = append(util.GetBytes(), b...)
+	err := c.writeNoCopy(msg, block)
 	if err != nil {
 		util.PutBytes(msg.Message)
 		written = 0
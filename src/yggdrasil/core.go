@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"io/ioutil"
+	"sync/atomic"
 	"time"
 
 	"github.com/gologme/log"
@@ -202,5 +203,11 @@ func (c *Core) Start(nc *config.NodeConfig, log *log.Logger) (*config.NodeState,
 
 // Stop shuts down the Yggdrasil node.
 func (c *Core) Stop() {
+	if atomic.LoadInt32(&c.router.started) == 0 {
+		// The node never got as far as starting the router, so there are no
+		// sessions to close, and nothing to close them with
+		return
+	}
 	c.log.Infoln("Stopping...")
+	c.router.doAdmin(c.sessions.closeAll)
 }
@@ -1,13 +1,14 @@
 package yggdrasil
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/yggdrasil-network/yggdrasil-go/src/crypto"
+	"github.com/yggdrasil-network/yggdrasil-go/src/util"
 )
 
 // Dialer represents an Yggdrasil connection dialer.
@@ -15,12 +16,17 @@ type Dialer struct {
 	core *Core
 }
 
-// TODO DialContext that allows timeouts/cancellation, Dial should just call this with no timeout set in the context
-
 // Dial opens a session to the given node. The first paramter should be "nodeid"
 // and the second parameter should contain a hexadecimal representation of the
 // target node ID.
 func (d *Dialer) Dial(network, address string) (*Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext works like Dial, but gives up if the context is canceled or its
+// deadline passes before the session is ready, in which case the half-open
+// session is closed. The session handshake timeout still applies.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (*Conn, error) {
 	var nodeID crypto.NodeID
 	var nodeMask crypto.NodeID
 	// Process
@@ -50,28 +56,112 @@ func (d *Dialer) Dial(network, address string) (*Conn, error) {
 				nodeMask[i] = 0xFF
 			}
 		}
-		return d.DialByNodeIDandMask(&nodeID, &nodeMask)
+		return d.DialByNodeIDandMaskContext(ctx, &nodeID, &nodeMask)
 	default:
 		// An unexpected address type was given, so give up
 		return nil, errors.New("unexpected address type")
 	}
 }
 
+// DialFlow opens a session for the given flow to a node matching the NodeID
+// and mask, preferring the node that the flow was connected to last time. This
+// means that if the session closes and the flow is dialed again, it goes back
+// to the same node (and so to any state that node holds for the flow), even if
+// other nodes match the mask. If that node can't be reached, then any node
+// matching the mask is dialed instead, and the flow is moved to it. Use
+// ClearFlowAffinity to forget where a flow was connected. Only the most
+// recently dialed flows are remembered, up to maxFlowAffinities of them.
+func (d *Dialer) DialFlow(flowKey uint64, nodeID, nodeMask *crypto.NodeID) (*Conn, error) {
+	return d.DialFlowContext(context.Background(), flowKey, nodeID, nodeMask)
+}
+
+// DialFlowContext works like DialFlow, but gives up if the context is canceled
+// or its deadline passes before the session is ready, in the same way as
+// DialContext.
+func (d *Dialer) DialFlowContext(ctx context.Context, flowKey uint64, nodeID, nodeMask *crypto.NodeID) (*Conn, error) {
+	var pinned crypto.NodeID
+	var isPinned bool
+	d.core.router.doAdmin(func() {
+		pinned, isPinned = d.core.sessions.getFlowAffinity(flowKey)
+	})
+	if isPinned {
+		matches := true
+		for idx := range pinned {
+			if pinned[idx]&nodeMask[idx] != nodeID[idx]&nodeMask[idx] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			var fullMask crypto.NodeID
+			for idx := range fullMask {
+				fullMask[idx] = 0xFF
+			}
+			conn, err := d.DialByNodeIDandMaskContext(ctx, &pinned, &fullMask)
+			switch {
+			case err == nil:
+				return conn, nil
+			case ctx.Err() != nil:
+				// Out of time, so don't try any other nodes
+				return nil, err
+			}
+		}
+	}
+	// The search overwrites the NodeID and mask, so don't pass the caller's
+	dest, mask := *nodeID, *nodeMask
+	conn, err := d.DialByNodeIDandMaskContext(ctx, &dest, &mask)
+	if err != nil {
+		return nil, err
+	}
+	connected := conn.RemoteAddr()
+	d.core.router.doAdmin(func() {
+		d.core.sessions.setFlowAffinity(flowKey, connected)
+	})
+	return conn, nil
+}
+
 // DialByNodeIDandMask opens a session to the given node based on raw
 // NodeID parameters.
 func (d *Dialer) DialByNodeIDandMask(nodeID, nodeMask *crypto.NodeID) (*Conn, error) {
+	return d.DialByNodeIDandMaskContext(context.Background(), nodeID, nodeMask)
+}
+
+// DialByNodeIDandMaskContext works like DialByNodeIDandMask, but gives up if
+// the context is canceled or its deadline passes before the session is ready.
+func (d *Dialer) DialByNodeIDandMaskContext(ctx context.Context, nodeID, nodeMask *crypto.NodeID) (*Conn, error) {
 	conn := newConn(d.core, nodeID, nodeMask, nil)
-	if err := conn.search(); err != nil {
+	if err := conn.search(ctx); err != nil {
+		if err == ctx.Err() {
+			return nil, dialContextError(err)
+		}
 		conn.Close()
 		return nil, err
 	}
-	t := time.NewTimer(6 * time.Second) // TODO use a context instead
-	defer t.Stop()
+	// The session is canceled by its handshake worker if the handshake doesn't
+	// complete in time, so there's no need for a separate timer here
 	select {
 	case <-conn.session.init:
 		return conn, nil
-	case <-t.C:
+	case <-ctx.Done():
+		// Closing the session also removes it from the session table, but
+		// don't close it if it finished its handshake in the mean time
+		if conn.session.cancelIfNotReady(ctx.Err()) {
+			return conn, nil
+		}
+		return nil, dialContextError(ctx.Err())
+	case <-conn.session.cancel.Finished():
 		conn.Close()
-		return nil, errors.New("session handshake timeout")
+		if conn.session.cancel.Error() == util.CancellationTimeoutError {
+			return nil, ConnError{errors.New("session handshake timeout"), true, false, false, 0}
+		}
+		return nil, ConnError{errors.New("session closed during handshake"), false, false, true, 0}
+	}
+}
+
+// Returns the error used when a dial gives up because of its context.
+func dialContextError(err error) error {
+	if err == context.DeadlineExceeded {
+		return ConnError{errors.New("dial deadline exceeded"), true, false, false, 0}
 	}
+	return ConnError{errors.New("dial canceled"), false, false, false, 0}
 }
@@ -25,6 +25,7 @@ package yggdrasil
 import (
 	//"bytes"
 
+	"sync/atomic"
 	"time"
 
 	"github.com/yggdrasil-network/yggdrasil-go/src/address"
@@ -44,6 +45,7 @@ type router struct {
 	reset       chan struct{}   // signal that coords changed (re-init sessions/dht)
 	admin       chan func()     // pass a lambda for the admin socket to query stuff
 	nodeinfo    nodeinfo
+	started     int32 // ATOMIC - 1 once the mainLoop goroutine has been started
 }
 
 // Initializes the router struct, which includes setting up channels to/from the adapter.
@@ -101,6 +103,7 @@ func (r *router) init(core *Core) {
 // Starts the mainLoop goroutine.
 func (r *router) start() error {
 	r.core.log.Infoln("Starting router")
+	atomic.StoreInt32(&r.started, 1)
 	go r.mainLoop()
 	return nil
 }
@@ -129,6 +132,10 @@ func (r *router) mainLoop() {
 				r.core.switchTable.doMaintenance()
 				r.core.dht.doMaintenance()
 				r.core.sessions.cleanup()
+				r.core.sessions.expireIdle()
+				r.core.sessions.rotateKeys()
+				r.core.sessions.checkOneWay()
+				r.core.sessions.saveTstampsIfNeeded()
 			}
 		case f := <-r.admin:
 			f()
@@ -205,6 +212,8 @@ func (r *router) handleProto(packet []byte) {
 		r.handlePing(bs, &p.FromKey)
 	case wire_SessionPong:
 		r.handlePong(bs, &p.FromKey)
+	case wire_SessionClose:
+		r.handleClose(bs, &p.FromKey)
 	case wire_NodeInfoRequest:
 		fallthrough
 	case wire_NodeInfoResponse:
@@ -233,6 +242,16 @@ func (r *router) handlePong(bs []byte, fromKey *crypto.BoxPubKey) {
 	r.handlePing(bs, fromKey)
 }
 
+// Decodes session close notifications and passes them to sessions.handleClose, which tears down the session.
+func (r *router) handleClose(bs []byte, fromKey *crypto.BoxPubKey) {
+	msg := sessionClose{}
+	if !msg.decode(bs) {
+		return
+	}
+	msg.SendPermPub = *fromKey
+	r.core.sessions.handleClose(&msg)
+}
+
 // Decodes dht requests and passes them to dht.handleReq to trigger a lookup/response.
 func (r *router) handleDHTReq(bs []byte, fromKey *crypto.BoxPubKey) {
 	req := dhtReq{}
@@ -198,10 +198,11 @@ func (sinfo *searchInfo) checkDHTRes(res *dhtRes) bool {
 	// They match, so create a session and send a sessionRequest
 	sess, isIn := sinfo.core.sessions.getByTheirPerm(&res.Key)
 	if !isIn {
-		sess = sinfo.core.sessions.createSession(&res.Key)
+		var err error
+		sess, err = sinfo.core.sessions.createSession(&res.Key, true)
 		if sess == nil {
 			// nil if the DHT search finished but the session wasn't allowed
-			sinfo.callback(nil, errors.New("session not allowed"))
+			sinfo.callback(nil, err)
 			// Cleanup
 			delete(sinfo.core.searches.searches, res.Dest)
 			return true
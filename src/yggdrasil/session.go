@@ -6,18 +6,224 @@ package yggdrasil
 
 import (
 	"bytes"
+	"compress/flate"
 	"container/heap"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
 	"github.com/yggdrasil-network/yggdrasil-go/src/crypto"
 	"github.com/yggdrasil-network/yggdrasil-go/src/util"
 )
 
-// Duration that we keep track of old nonces per session, to allow some out-of-order packet delivery
-const nonceWindow = time.Second
+// The smallest MTU that a session can have, which is the minimum MTU for IPv6,
+// and is assumed until the remote node says otherwise
+const minSessionMTU = 1280
+
+// Default duration that we keep track of old nonces per session, to allow some out-of-order packet delivery
+const defaultNonceWindow = time.Second
+
+// Default number of old nonces that we keep track of per session, regardless of how old they are
+const defaultNonceHeapSize = 64
+
+// Most old nonces that we keep track of per session, however recent they are,
+// so that a burst of packets within the nonce window can't use unbounded memory.
+// Configured heap sizes bigger than this are lowered to it.
+const maxTrackedNonces = 4096
+
+// How many packets can be queued on a session's recv and send channels by
+// default, if the session options don't say otherwise
+const defaultSessionBufferSize = 32
+
+// Most packets that can be queued on a session's recv or send channel, since
+// the channels are allocated up front for every session
+const maxSessionBufferSize = 65536
+
+// Default duration that we wait for a new session to finish its handshake, if not configured
+const defaultHandshakeTimeout = 6 * time.Second
+
+// Minimum time that we keep accepting packets under the old key after rotating
+// our own session key, since the remote end can't switch until our ping arrives
+const minKeyRotationGrace = 5 * time.Second
+
+// Shortest time between rotations of our session keys because of the amount of
+// traffic sent, since each rotation needs a ping with a newer tstamp
+const minKeyRotationInterval = time.Second
+
+// Most flows that Dialer.DialFlow remembers the node for, after which the least
+// recently dialed are forgotten
+const maxFlowAffinities = 4096
+
+// Number of times we try to generate an unused handle before giving up on a new session
+const maxHandleAttempts = 8
+
+// Node-wide number of outstanding worker callbacks, across all sessions, above
+// which the busiest sessions have to wait for theirs to finish before doing more
+const maxCallbacks = 4096
+
+// Sessions with fewer outstanding callbacks than this are never made to wait,
+// so that quiet sessions aren't held up by busy ones
+const minCallbacksUnderPressure = 8
+
+// Number of one-minute buckets of session establishment outcomes that we keep
+const establishmentBuckets = 10
+
+// Counts of session establishment outcomes within a single minute
+type establishmentBucket struct {
+	minute    int64  // Unix time in minutes, used to tell if the bucket is stale
+	succeeded uint64 // Sessions that finished initializing
+	failed    uint64 // Sessions that were refused, or closed before initializing
+}
+
+// Names of optional features that can be toggled on individual sessions at runtime
+const (
+	sessionFeatureStrictOrdering = "strict_ordering" // Drop out-of-order packets, instead of allowing them within the nonce window
+	sessionFeatureTraceIDs       = "trace_ids"       // Carry a trace ID inside each encrypted packet, advertised in our pings
+)
+
+// Returns true if the name is one of the optional session features above.
+func isSessionFeature(name string) bool {
+	switch name {
+	case sessionFeatureStrictOrdering, sessionFeatureTraceIDs:
+		return true
+	}
+	return false
+}
+
+// Longest header that the trace_ids feature adds to the start of each packet:
+// a flag byte, which is 1 if a trace ID follows or 0 if not, and the trace ID.
+// Every packet under a session key that was advertised with trace IDs has the
+// header, so the receiver never has to guess whether it's there.
+const traceHeaderLen = 9
+
+// Markers at the start of every packet under a pair of session keys that were
+// both advertised with compression, saying whether the rest of the packet is
+// compressed or not
+const (
+	compressNone  byte = 0 // Sent as-is, because compressing didn't make it smaller
+	compressFlate byte = 1 // Compressed with DEFLATE
+)
+
+// The most received packets that the recv worker decrypts as a batch, taking
+// the session mutex once for the whole batch instead of once per packet
+const maxRecvBatch = 32
+
+// The most packets that the send worker encrypts as a batch, taking the
+// session mutex once for the whole batch instead of once per packet
+const maxSendBatch = 32
+
+// Packets shorter than this are never worth compressing, so they're sent as-is
+// without trying
+const minCompressLen = 128
+
+// The largest packet that a compressed packet can decompress to, so that a
+// small packet can't be used to make us allocate huge amounts of memory
+const maxDecompressedLen = 65535
+
+// Flags in a session ping, saying which optional capabilities the sender has
+// enabled, so that both ends only use them if both agree
+const (
+	sessionPingCompression uint64 = 1 << iota // The sender can send and receive compressed packets under this session key
+	sessionPingTraceIDs                       // The sender puts a trace header in front of every packet under this session key
+)
+
+// Number of send priorities that flows can be given, from 0 (the default) up,
+// and how many packets in a row can be sent from higher priority flows before
+// a waiting lower priority flow gets to send one
+const numFlowPriorities = 4
+const maxPrioritySkips = 8
+
+// How often sessions are checked for one-way traffic, and the fewest packets
+// that have to be sent in that time, without any being received, for a session
+// to be flagged as one-way. Applications that only send now and then, or that
+// get any replies at all, aren't flagged.
+const oneWayWindow = 30 * time.Second
+const oneWayMinPackets = 32
+
+// The shortest time between saves of the session tstamp store
+const tstampSaveInterval = time.Minute
+
+// The most tstamps that are kept in the session tstamp store. Once there are
+// more, the oldest are forgotten, since those nodes are the least likely to
+// open a session with us again
+const maxStoredTstamps = 4096
+
+// Reasons that a received packet can be dropped by a session, used to index
+// the per-session drop counters
+type sessionDropReason int
+
+const (
+	dropInvalidNonce   sessionDropReason = iota // The nonce was too old or already seen
+	dropDecryptFailed                           // The packet couldn't be decrypted
+	dropSessionUpdated                          // The session keys or nonces changed while decrypting
+	dropStaleKey                                // Sent under the previous session key, after the grace window
+	dropBufferFull                              // Too many packets were waiting to be decrypted
+	dropRateLimited                             // More packets per second were received than the limit allows
+	dropBadCompression                          // The packet couldn't be decompressed
+	dropBadTraceHeader                          // The packet should have had a trace header, but didn't
+	numDropReasons
+)
+
+// Names of the drop reasons, as shown in the admin API
+var sessionDropReasonNames = [numDropReasons]string{
+	dropInvalidNonce:   "invalid_nonce",
+	dropDecryptFailed:  "decrypt_failed",
+	dropSessionUpdated: "session_updated",
+	dropStaleKey:       "stale_key",
+	dropBufferFull:     "buffer_full",
+	dropRateLimited:    "rate_limited",
+	dropBadCompression: "bad_compression",
+	dropBadTraceHeader: "bad_trace_header",
+}
+
+// Results of checking a session ping in update, used to index the per-session
+// ping counters
+type sessionPingResult int
+
+const (
+	pingAccepted        sessionPingResult = iota // The ping was OK, and the session was updated
+	pingReplayed                                 // The tstamp wasn't newer than the last ping's, so it may be a replay
+	pingFromFuture                               // The tstamp was too far in the future
+	pingHandleCollision                          // The ping was from a different node whose session has the same handle
+	numPingResults
+)
+
+// Names of the ping results, as shown in the admin API
+var sessionPingResultNames = [numPingResults]string{
+	pingAccepted:        "accepted",
+	pingReplayed:        "replayed",
+	pingFromFuture:      "future_tstamp",
+	pingHandleCollision: "handle_collision",
+}
+
+// Running totals of the traffic counters of every session, used to work out
+// node-wide statistics
+type sessionTotals struct {
+	bytesSent  uint64
+	bytesRecvd uint64
+	drops      [numDropReasons]uint64
+}
+
+// Adds the counters of a session to the totals. The caller must hold the
+// session mutex.
+func (t *sessionTotals) add(sinfo *sessionInfo) {
+	t.bytesSent += atomic.LoadUint64(&sinfo.bytesSent)
+	t.bytesRecvd += atomic.LoadUint64(&sinfo.bytesRecvd)
+	for reason, count := range sinfo.drops {
+		t.drops[reason] += count
+	}
+}
 
 // A heap of nonces, used with a map[nonce]time to allow out-of-order packets a little time to arrive without rejecting them
 type nonceHeap []crypto.BoxNonce
@@ -32,11 +238,15 @@ func (h *nonceHeap) Pop() interface{} {
 	n, *h = (*h)[l-1], (*h)[:l-1]
 	return n
 }
-func (h nonceHeap) peek() *crypto.BoxNonce { return &h[len(h)-1] }
+func (h nonceHeap) peek() *crypto.BoxNonce { return &h[0] }
 
 // All the information we know about an active session.
 // This includes coords, permanent and ephemeral keys, handles and nonces, various sorts of timing information for timeout and maintenance, and some metadata for the admin API.
+// The ATOMIC fields come first, so that they are 64-bit aligned on 32-bit platforms.
 type sessionInfo struct {
+	bytesSent      uint64                        // ATOMIC - Bytes of real traffic sent in this session
+	bytesRecvd     uint64                        // ATOMIC - Bytes of real traffic received in this session
+	tstamp         int64                         // ATOMIC - tstamp from their last session ping, replay attack mitigation
 	mutex          sync.Mutex                    // Protects all of the below, use it any time you read/chance the contents of a session
 	core           *Core                         //
 	reconfigure    chan chan error               //
@@ -52,24 +262,64 @@ type sessionInfo struct {
 	theirNonce     crypto.BoxNonce               //
 	theirNonceHeap nonceHeap                     // priority queue to keep track of the lowest nonce we recently accepted
 	theirNonceMap  map[crypto.BoxNonce]time.Time // time we added each nonce to the heap
+	nonceWindow    time.Duration                 // how long to keep old nonces in the heap for
+	nonceHeapSize  int                           // how many old nonces to keep in the heap, regardless of age
+	prevSesKey     crypto.BoxSharedKey           // shared key from before their session key last changed
+	hasPrevSesKey  bool                          // true if prevSesKey is set, until prevKeyExpires passes
+	prevKeyExpires time.Time                     // packets under prevSesKey are accepted until this time
+	prevNonce      crypto.BoxNonce               // like theirNonce, but for packets under prevSesKey
+	prevNonceHeap  nonceHeap                     // like theirNonceHeap, but for packets under prevSesKey
+	prevNonceMap   map[crypto.BoxNonce]time.Time // like theirNonceMap, but for packets under prevSesKey
+	staleKeyGrace  time.Duration                 // how long to keep accepting packets under prevSesKey for
+	sendRateLimit  uint64                        // maximum bytes per second of traffic to send, or 0 for no limit
+	sendRateBurst  uint64                        // bytes that can be sent at once while under sendRateLimit, or 0 for one second's worth
+	recvPktLimit   uint64                        // maximum packets per second to accept, or 0 for no limit
+	recvPktRate    sessionPacketRate             // measures the rate that packets are received at, including dropped ones
+	wantCompress   bool                          // compression is enabled in the config, applied to myCompress when keys are next rotated
+	myCompress     bool                          // compression is advertised with mySesPub in our pings
+	theirCompress  bool                          // compression was advertised with theirSesPub in their pings
+	prevCompress   bool                          // packets under prevSesKey have a compression marker
+	myTraceIDs     bool                          // we send a trace header with every packet under mySesPub, advertised in our pings
+	theirTraceIDs  bool                          // they send a trace header with every packet under theirSesPub
+	prevTraceIDs   bool                          // like theirTraceIDs, but for packets under prevSesKey
+	staleKeyRecvd  uint64                        // packets accepted under prevSesKey during the grace window
+	reordered      uint64                        // packets accepted with an older nonce than theirNonce, i.e. out of order
+	pingResults    [numPingResults]uint64        // session pings checked by update, by result
+	handleRetries  uint64                        // handles that were already in use by another session when myHandle was picked
+	lastPingReject sessionPingResult             // why update last rejected a ping, or pingAccepted if it never has
+	keyTime        time.Time                     // time mySesPub was generated, used for key rotation
+	keyBytesSent   uint64                        // bytes of traffic sent since mySesPub was generated
+	myTstamp       int64                         // tstamp of our last ping or close, so that the next one is always newer
+	keyRotateBytes uint64                        // rotate our session keys after sending this many bytes, or 0 to never
+	rotate         chan struct{}                 // Tells the send worker to rotate our session keys
 	myNonce        crypto.BoxNonce               //
 	theirMTU       uint16                        //
 	myMTU          uint16                        //
+	maxMTU         uint16                        // upper bound on the MTU, regardless of what both ends support, or 0 for no limit
 	wasMTUFixed    bool                          // Was the MTU fixed by a receive error?
+	lastMTU        uint16                        // result of getMTU when the MTU handler was last called
 	timeOpened     time.Time                     // Time the sessino was opened
+	isInbound      bool                          // The remote node opened the session, never changes so safe to read without the mutex
 	time           time.Time                     // Time we last received a packet
 	mtuTime        time.Time                     // time myMTU was last changed
 	pingTime       time.Time                     // time the first ping was sent since the last received packet
 	pingSend       time.Time                     // time the last ping was sent
+	pingsPending   int                           // pings sent since the last pong was received
+	latency        time.Duration                 // smoothed round-trip time, measured from ping/pong exchanges
 	coords         []byte                        // coords of destination
 	reset          bool                          // reset if coords change
-	tstamp         int64                         // ATOMIC - tstamp from their last session ping, replay attack mitigation
-	bytesSent      uint64                        // Bytes of real traffic sent in this session
-	bytesRecvd     uint64                        // Bytes of real traffic received in this session
+	packetsSent    uint64                        // Packets of real traffic sent in this session
+	packetsRecvd   uint64                        // Packets of real traffic received in this session
+	oneWayTime     time.Time                     // Start of the current one-way traffic check
+	oneWaySent     uint64                        // packetsSent at oneWayTime
+	oneWayRecvd    uint64                        // packetsRecvd at oneWayTime
+	isOneWay       bool                          // Traffic was sent but none received during the last check
+	drops          [numDropReasons]uint64        // Received packets dropped by this session, by reason
+	features       map[string]bool               // Optional features enabled for this session, toggled at runtime
 	init           chan struct{}                 // Closed when the first session pong arrives, used to signal that the session is ready for initial use
 	cancel         util.Cancellation             // Used to terminate workers
 	fromRouter     chan wire_trafficPacket       // Received packets go here, to be decrypted by the session
-	recv           chan []byte                   // Decrypted packets go here, picked up by the associated Conn
+	recv           chan recvMessage              // Decrypted packets go here, picked up by the associated Conn
 	send           chan FlowKeyMessage           // Packets with optional flow key go here, to be encrypted and sent
 }
 
@@ -79,6 +329,12 @@ func (sinfo *sessionInfo) doFunc(f func()) {
 	f()
 }
 
+// Returns true if the named optional feature is enabled for this session.
+// The caller must hold the session mutex.
+func (sinfo *sessionInfo) hasFeature(name string) bool {
+	return sinfo.features[name]
+}
+
 // Represents a session ping/pong packet, andincludes information like public keys, a session handle, coords, a timestamp to prevent replays, and the tun/tap MTU.
 type sessionPing struct {
 	SendPermPub crypto.BoxPubKey // Sender's permanent key
@@ -88,46 +344,77 @@ type sessionPing struct {
 	Tstamp      int64            // unix time, but the only real requirement is that it increases
 	IsPong      bool             //
 	MTU         uint16           //
+	Compression bool             // Sender can send and receive compressed packets under SendSesPub
+	TraceIDs    bool             // Sender puts a trace header in front of every packet under SendSesPub
+}
+
+// Represents a session close packet, which tells the remote end that a session is being closed, so it doesn't have to wait for the session to time out.
+// Like a ping, it's sealed to the permanent keys, and carries the sender's handle and a timestamp so it can't be forged or replayed into another session.
+type sessionClose struct {
+	SendPermPub crypto.BoxPubKey // Sender's permanent key
+	Handle      crypto.Handle    // Sender's handle for the session being closed
+	Tstamp      int64            // unix time, must be newer than the last ping
 }
 
+// Used to cancel sessions which were closed by the remote end, so that we
+// don't send a close notification back to them.
+var errSessionClosedRemotely = errors.New("session closed by remote node")
+
 // Updates session info in response to a ping, after checking that the ping is OK.
-// Returns true if the session was updated, or false otherwise.
-func (s *sessionInfo) update(p *sessionPing) bool {
-	if !(p.Tstamp > s.tstamp) {
+// Returns pingAccepted if the session was updated, or otherwise the reason why
+// the ping was rejected.
+func (s *sessionInfo) update(p *sessionPing) sessionPingResult {
+	if !(p.Tstamp > atomic.LoadInt64(&s.tstamp)) {
 		// To protect against replay attacks
-		return false
+		return pingReplayed
+	}
+	if skew := s.core.sessions.maxPingSkew; skew > 0 && p.Tstamp > s.core.sessions.now().Add(skew).Unix() {
+		// Otherwise the remote end could make us reject its normal pings until real time catches up
+		s.core.log.Debugln("Rejected session ping with a timestamp too far in the future:", p.Tstamp)
+		return pingFromFuture
 	}
 	if p.SendPermPub != s.theirPermPub {
 		// Should only happen if two sessions got the same handle
 		// That shouldn't be allowed anyway, but if it happens then let one time out
-		return false
+		return pingHandleCollision
 	}
 	if p.SendSesPub != s.theirSesPub {
+		if s.theirSesPub != (crypto.BoxPubKey{}) {
+			// Keep the old key around, so packets which were sent before the
+			// remote end rotated keys aren't mistaken for garbage
+			s.retireSesKey(s.staleKeyGrace)
+		}
 		s.theirSesPub = p.SendSesPub
+		// These only change along with the key, so the format of the packets is
+		// always known from the key they were encrypted with
+		s.theirTraceIDs = p.TraceIDs
+		s.theirCompress = p.Compression
 		s.theirHandle = p.Handle
 		s.sharedSesKey = *crypto.GetSharedKey(&s.mySesPriv, &s.theirSesPub)
 		s.theirNonce = crypto.BoxNonce{}
 		s.theirNonceHeap = nil
 		s.theirNonceMap = make(map[crypto.BoxNonce]time.Time)
 	}
-	if p.MTU >= 1280 || p.MTU == 0 {
+	if p.MTU >= minSessionMTU || p.MTU == 0 {
 		s.theirMTU = p.MTU
+		s.checkMTU()
 	}
 	if !bytes.Equal(s.coords, p.Coords) {
 		// allocate enough space for additional coords
 		s.coords = append(make([]byte, 0, len(p.Coords)+11), p.Coords...)
 	}
-	s.time = time.Now()
-	s.tstamp = p.Tstamp
+	s.time = s.core.sessions.now()
+	atomic.StoreInt64(&s.tstamp, p.Tstamp)
 	s.reset = false
-	defer func() { recover() }() // Recover if the below panics
+	// Only update closes init, and it's always called with the session mutex
+	// held, so checking first means that init can never be closed twice
 	select {
 	case <-s.init:
 	default:
 		// Unblock anything waiting for the session to initialize
 		close(s.init)
 	}
-	return true
+	return pingAccepted
 }
 
 // Struct of all active sessions.
@@ -139,38 +426,217 @@ type sessions struct {
 	listenerMutex    sync.Mutex
 	reconfigure      chan chan error
 	lastCleanup      time.Time
+	now              func() time.Time                                    // Returns the current time, always time.Now outside of tests
+	newHandle        func(prefix []byte) *crypto.Handle                  // Generates session handles, always crypto.NewHandleWithPrefix outside of tests
+	callbacks        int32                                               // ATOMIC - number of outstanding worker callbacks across all sessions
+	isFrozen         bool                                                // Refuse to create new sessions if true
+	frozenRefused    uint64                                              // Number of new sessions refused while frozen
+	halfOpen         int                                                 // Number of sessions which haven't finished their handshake yet
+	maxHalfOpen      int                                                 // Refuse to create new sessions if this many are half-open, or 0 for no limit
+	maxSessions      int                                                 // Refuse to create new sessions if this many are open, or 0 for no limit
+	halfOpenRefused  uint64                                              // Number of new sessions refused because too many were half-open
+	handlePrefix     []byte                                              // Configured prefix for our session handles, already decoded
+	establishments   [establishmentBuckets]establishmentBucket           // Recent session establishment outcomes, by minute
+	nonceWindow      time.Duration                                       // Configured nonce window, copied into new sessions
+	nonceHeapSize    int                                                 // Configured nonce heap size, copied into new sessions
+	recvBufferSize   int                                                 // Configured recv channel size, used for new sessions
+	sendBufferSize   int                                                 // Configured send channel size, used for new sessions
+	closedTotals     sessionTotals                                       // Traffic counters of sessions that have since closed
+	lastTotals       sessionTotals                                       // Node-wide traffic counters when getTotals was last called
+	lastTotalsTime   time.Time                                           // Time that getTotals was last called
+	eventListeners   []chan<- SessionEvent                               // Channels to notify when sessions open or close
+	flowAffinity     map[uint64]*flowAffinityEntry                       // Maps flow keys onto the node that Dialer.DialFlow last connected them to
+	mtuPins          map[crypto.BoxPubKey]uint16                         // MTUs set with Core.SetSessionMTU, used instead of IfMTU for sessions with these nodes
+	flowPriorities   map[uint64]int                                      // Maps flow keys onto their send priority, if it isn't the default
+	flowPriorityLock sync.RWMutex                                        // Protects the above, since it's used by the send workers
+	staleKeyGrace    time.Duration                                       // Configured stale session key grace period, copied into new sessions
+	keyRotation      time.Duration                                       // Configured session key rotation interval, or 0 to never rotate
+	keyRotateBytes   uint64                                              // Configured session key rotation threshold, copied into new sessions
+	maxPingSkew      time.Duration                                       // How far in the future a ping tstamp may be, or 0 for no limit
+	idleTimeout      time.Duration                                       // How long a session can go without receiving anything before it's closed, or 0 to never
+	tstampStore      string                                              // File to keep the tstamps below in across restarts, or "" to not keep them
+	tstamps          map[crypto.BoxPubKey]int64                          // Highest ping tstamp seen from each node, only used if tstampStore is set
+	tstampsDirty     bool                                                // The tstamps have changed since they were last saved
+	tstampsSaved     time.Time                                           // Time the tstamps were last saved
 	isAllowedHandler func(pubkey *crypto.BoxPubKey, initiator bool) bool // Returns true or false if session setup is allowed
+	isAllowedAddr    sessionAddrGatekeeper                               // Like isAllowedHandler, but given the address and subnet of the remote node
 	isAllowedMutex   sync.RWMutex                                        // Protects the above
-	permShared       map[crypto.BoxPubKey]*crypto.BoxSharedKey           // Maps known permanent keys to their shared key, used by DHT a lot
+	mtuHandler       sessionMTUHandler                                   // Called when the MTU of a session changes
+	mtuHandlerMutex  sync.RWMutex                                        // Protects the above
+	permShared       map[crypto.BoxPubKey]*permSharedEntry               // Maps known permanent keys to their shared key, used by DHT a lot
+	permSharedMutex  sync.Mutex                                          // Protects the above, since it's used outside of the router goroutine
 	sinfos           map[crypto.Handle]*sessionInfo                      // Maps handle onto session info
 	byTheirPerm      map[crypto.BoxPubKey]*crypto.Handle                 // Maps theirPermPub onto handle
+	byTheirAddr      map[address.Address]*crypto.Handle                  // Maps theirAddr onto handle
+	byTheirSubnet    map[address.Subnet]*crypto.Handle                   // Maps theirSubnet onto handle
+}
+
+// Decides whether a session is allowed, given the address and subnet derived
+// from the remote node's permanent key, and whether we initiated the session.
+type sessionAddrGatekeeper func(addr *address.Address, subnet *address.Subnet, initiator bool) bool
+
+// Told the address of the remote node and the new MTU whenever the MTU of a
+// session changes.
+type sessionMTUHandler func(addr address.Address, mtu uint16)
+
+// A cached shared key, along with the last time it was used, so that the least
+// recently used keys are the first to be removed from the cache.
+type permSharedEntry struct {
+	key      *crypto.BoxSharedKey
+	lastUsed time.Time
+}
+
+// The node that a flow was last connected to, along with the last time it was
+// dialed, so that the least recently dialed flows are the first to be forgotten.
+type flowAffinityEntry struct {
+	node     crypto.NodeID
+	lastUsed time.Time
 }
 
 // Initializes the session struct.
 func (ss *sessions) init(core *Core) {
 	ss.core = core
+	ss.now = time.Now
+	ss.newHandle = crypto.NewHandleWithPrefix
 	ss.reconfigure = make(chan chan error, 1)
 	go func() {
 		for {
 			e := <-ss.reconfigure
-			responses := make(map[crypto.Handle]chan error)
-			for index, session := range ss.sinfos {
-				responses[index] = make(chan error)
-				session.reconfigure <- responses[index]
-			}
-			for _, response := range responses {
-				if err := <-response; err != nil {
-					e <- err
+			var sinfos []*sessionInfo
+			ss.core.router.doAdmin(func() {
+				ss.loadConfig()
+				for _, sinfo := range ss.sinfos {
+					sinfos = append(sinfos, sinfo)
+				}
+			})
+			var err error
+			for _, sinfo := range sinfos {
+				// Skip any sessions that close while we're waiting on them
+				response := make(chan error, 1)
+				select {
+				case sinfo.reconfigure <- response:
+				case <-sinfo.cancel.Finished():
 					continue
 				}
+				select {
+				case serr := <-response:
+					if serr != nil {
+						err = serr
+					}
+				case <-sinfo.cancel.Finished():
+				}
 			}
-			e <- nil
+			e <- err
 		}
 	}()
-	ss.permShared = make(map[crypto.BoxPubKey]*crypto.BoxSharedKey)
+	ss.loadConfig()
+	ss.permShared = make(map[crypto.BoxPubKey]*permSharedEntry)
 	ss.sinfos = make(map[crypto.Handle]*sessionInfo)
 	ss.byTheirPerm = make(map[crypto.BoxPubKey]*crypto.Handle)
-	ss.lastCleanup = time.Now()
+	ss.byTheirAddr = make(map[address.Address]*crypto.Handle)
+	ss.byTheirSubnet = make(map[address.Subnet]*crypto.Handle)
+	ss.flowAffinity = make(map[uint64]*flowAffinityEntry)
+	ss.flowPriorities = make(map[uint64]int)
+	ss.mtuPins = make(map[crypto.BoxPubKey]uint16)
+	ss.lastCleanup = ss.now()
+	ss.lastTotalsTime = ss.lastCleanup
+}
+
+// Loads the session options from the current config, using the defaults for
+// anything that isn't set.
+func (ss *sessions) loadConfig() {
+	current := ss.core.config.GetCurrent()
+	var isClamped bool
+	if ss.nonceWindow, ss.nonceHeapSize, isClamped = getNonceOptions(&current.SessionOptions); isClamped {
+		ss.core.log.Warnln("NonceHeapSize is too large, using", ss.nonceHeapSize, "instead")
+	}
+	ss.staleKeyGrace = time.Duration(current.SessionOptions.StaleKeyGracePeriod) * time.Millisecond
+	ss.keyRotation = time.Duration(current.SessionOptions.KeyRotationInterval) * time.Second
+	ss.keyRotateBytes = current.SessionOptions.KeyRotationBytes
+	ss.maxPingSkew = time.Duration(current.SessionOptions.MaxPingSkew) * time.Second
+	ss.idleTimeout = time.Duration(current.SessionOptions.IdleTimeout) * time.Second
+	ss.maxHalfOpen = int(current.SessionOptions.MaxHalfOpen)
+	ss.maxSessions = int(current.SessionOptions.MaxSessions)
+	if ss.recvBufferSize, isClamped = getBufferSize(current.SessionOptions.RecvBufferSize); isClamped {
+		ss.core.log.Warnln("RecvBufferSize is too large, using", ss.recvBufferSize, "instead")
+	}
+	if ss.sendBufferSize, isClamped = getBufferSize(current.SessionOptions.SendBufferSize); isClamped {
+		ss.core.log.Warnln("SendBufferSize is too large, using", ss.sendBufferSize, "instead")
+	}
+	if prefix, err := getHandlePrefix(&current.SessionOptions); err == nil {
+		ss.handlePrefix = prefix
+	} else {
+		ss.handlePrefix = nil
+		ss.core.log.Warnln("Ignoring invalid session handle prefix:", err)
+	}
+	if current.SessionOptions.TimestampStore != ss.tstampStore {
+		ss.tstampStore = current.SessionOptions.TimestampStore
+		ss.loadTstamps()
+	}
+}
+
+// Gets a recv or send channel size from the session options, using the default
+// if it isn't set. Sizes over maxSessionBufferSize are lowered to it, in which
+// case isClamped is true.
+func getBufferSize(size uint64) (bufferSize int, isClamped bool) {
+	switch {
+	case size == 0:
+		return defaultSessionBufferSize, false
+	case size > maxSessionBufferSize:
+		return maxSessionBufferSize, true
+	}
+	return int(size), false
+}
+
+// Decodes the session handle prefix from the session options, or returns nil if
+// there isn't one.
+func getHandlePrefix(options *config.SessionOptions) ([]byte, error) {
+	if options.HandlePrefix == "" {
+		return nil, nil
+	}
+	return hex.DecodeString(options.HandlePrefix)
+}
+
+// Gets the nonce window settings from the session options, using the defaults
+// for anything that isn't set. Heap sizes over maxTrackedNonces are lowered to
+// it, in which case isClamped is true.
+func getNonceOptions(options *config.SessionOptions) (window time.Duration, heapSize int, isClamped bool) {
+	window, heapSize = defaultNonceWindow, defaultNonceHeapSize
+	if options.NonceWindow > 0 {
+		window = time.Duration(options.NonceWindow) * time.Millisecond
+	}
+	switch {
+	case options.NonceHeapSize > maxTrackedNonces:
+		heapSize, isClamped = maxTrackedNonces, true
+	case options.NonceHeapSize > 0:
+		heapSize = int(options.NonceHeapSize)
+	}
+	return window, heapSize, isClamped
+}
+
+// Gets the upper bound on session MTUs from the session options, or 0 if there
+// isn't one. Anything lower than the minimum MTU is raised to it.
+func getMaxMTU(options *config.SessionOptions) uint16 {
+	switch {
+	case options.MaxMTU == 0:
+		return 0
+	case options.MaxMTU < minSessionMTU:
+		return minSessionMTU
+	case options.MaxMTU > 65535:
+		return 65535
+	}
+	return uint16(options.MaxMTU)
+}
+
+// Gets the send rate limit for sessions with the given key from the session
+// options, using the per-key override if there is one, or the global limit.
+func getSendRateLimit(options *config.SessionOptions, key *crypto.BoxPubKey) uint64 {
+	for k, limit := range options.SendRateLimitOverrides {
+		if bs, err := hex.DecodeString(k); err == nil && bytes.Equal(bs, key[:]) {
+			return limit
+		}
+	}
+	return options.SendRateLimit
 }
 
 // Determines whether the session with a given publickey is allowed based on
@@ -179,11 +645,16 @@ func (ss *sessions) isSessionAllowed(pubkey *crypto.BoxPubKey, initiator bool) b
 	ss.isAllowedMutex.RLock()
 	defer ss.isAllowedMutex.RUnlock()
 
-	if ss.isAllowedHandler == nil {
-		return true
+	if ss.isAllowedHandler != nil && !ss.isAllowedHandler(pubkey, initiator) {
+		return false
+	}
+
+	if ss.isAllowedAddr != nil {
+		nodeID := crypto.GetNodeID(pubkey)
+		return ss.isAllowedAddr(address.AddrForNodeID(nodeID), address.SubnetForNodeID(nodeID), initiator)
 	}
 
-	return ss.isAllowedHandler(pubkey, initiator)
+	return true
 }
 
 // Gets the session corresponding to a given handle.
@@ -202,40 +673,293 @@ func (ss *sessions) getByTheirPerm(key *crypto.BoxPubKey) (*sessionInfo, bool) {
 	return sinfo, isIn
 }
 
+// Returns the sessions which haven't finished their handshake yet.
+func (ss *sessions) getHalfOpen() []*sessionInfo {
+	var sinfos []*sessionInfo
+	for _, sinfo := range ss.sinfos {
+		select {
+		case <-sinfo.init:
+		default:
+			sinfos = append(sinfos, sinfo)
+		}
+	}
+	return sinfos
+}
+
+// Gets a session corresponding to the address of the remote node.
+func (ss *sessions) getByAddress(addr *address.Address) (*sessionInfo, bool) {
+	h, isIn := ss.byTheirAddr[*addr]
+	if !isIn {
+		return nil, false
+	}
+	return ss.getSessionForHandle(h)
+}
+
+// Gets a session corresponding to the subnet of the remote node.
+func (ss *sessions) getBySubnet(subnet *address.Subnet) (*sessionInfo, bool) {
+	h, isIn := ss.byTheirSubnet[*subnet]
+	if !isIn {
+		return nil, false
+	}
+	return ss.getSessionForHandle(h)
+}
+
+// Returns a snapshot of every open session, which is safe to keep using after
+// sessions are opened or closed.
+func (ss *sessions) getAll() []*sessionInfo {
+	sinfos := make([]*sessionInfo, 0, len(ss.sinfos))
+	for _, sinfo := range ss.sinfos {
+		sinfos = append(sinfos, sinfo)
+	}
+	return sinfos
+}
+
+// Takes a snapshot of the traffic statistics of every open session. Each
+// session's mutex is taken while reading it, since the workers update these
+// fields concurrently.
+func (ss *sessions) getSessionStats() []SessionStats {
+	var stats []SessionStats
+	now := ss.now()
+	for _, sinfo := range ss.sinfos {
+		var s SessionStats
+		sinfo.doFunc(func() {
+			s = SessionStats{
+				PublicKey:        sinfo.theirPermPub,
+				Address:          sinfo.theirAddr,
+				BytesSent:        atomic.LoadUint64(&sinfo.bytesSent),
+				BytesRecvd:       atomic.LoadUint64(&sinfo.bytesRecvd),
+				Uptime:           now.Sub(sinfo.timeOpened),
+				LastPacket:       now.Sub(sinfo.time),
+				Latency:          sinfo.latency,
+				StaleKeyAccepted: sinfo.staleKeyRecvd,
+				StaleKeyDropped:  sinfo.drops[dropStaleKey],
+				FuturePings:      sinfo.pingResults[pingFromFuture],
+				ReplayedPings:    sinfo.pingResults[pingReplayed],
+				HandleCollisions: sinfo.handleRetries + sinfo.pingResults[pingHandleCollision],
+				LastRejectedPing: sinfo.getLastPingReject(),
+				RecvPacketLimit:  sinfo.recvPktLimit,
+				RecvPacketRate:   sinfo.recvPktRate.get(now),
+				RateLimited:      sinfo.drops[dropRateLimited],
+				InvalidNonce:     sinfo.drops[dropInvalidNonce],
+				DecryptFailed:    sinfo.drops[dropDecryptFailed],
+				Reordered:        sinfo.reordered,
+				OneWay:           sinfo.isOneWay,
+			}
+		})
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// Adds to (or subtracts from) the node-wide count of outstanding callbacks.
+func (ss *sessions) addCallbacks(n int) {
+	atomic.AddInt32(&ss.callbacks, int32(n))
+}
+
+// Returns true if a worker with the given number of outstanding callbacks
+// should finish some of them before doing anything else, because there are too
+// many outstanding across the whole node.
+func (ss *sessions) isUnderPressure(pending int) bool {
+	return pending >= minCallbacksUnderPressure && atomic.LoadInt32(&ss.callbacks) >= maxCallbacks
+}
+
+// Works out node-wide traffic statistics, by adding the counters of every open
+// session to the running totals of sessions which have already closed. The
+// throughput is averaged over the time since the last call.
+func (ss *sessions) getTotals() NodeTrafficStats {
+	totals := ss.closedTotals
+	for _, sinfo := range ss.sinfos {
+		sinfo.doFunc(func() {
+			totals.add(sinfo)
+		})
+	}
+	now := ss.now()
+	stats := NodeTrafficStats{
+		Sessions:   len(ss.sinfos),
+		BytesSent:  totals.bytesSent,
+		BytesRecvd: totals.bytesRecvd,
+		Drops:      make(map[string]uint64),
+		Callbacks:  int(atomic.LoadInt32(&ss.callbacks)),
+	}
+	for reason, count := range totals.drops {
+		stats.Drops[sessionDropReasonNames[reason]] = count
+	}
+	if elapsed := now.Sub(ss.lastTotalsTime).Seconds(); elapsed > 0 {
+		stats.SendRate = float64(totals.bytesSent-ss.lastTotals.bytesSent) / elapsed
+		stats.RecvRate = float64(totals.bytesRecvd-ss.lastTotals.bytesRecvd) / elapsed
+	}
+	ss.lastTotals = totals
+	ss.lastTotalsTime = now
+	return stats
+}
+
+// Gets all sessions which have sent pings since they last received anything,
+// and haven't received anything for more than the given threshold. These are
+// likely to be failing.
+func (ss *sessions) getUnresponsive(threshold time.Duration) []*sessionInfo {
+	var unresponsive []*sessionInfo
+	now := ss.now()
+	for _, sinfo := range ss.sinfos {
+		sinfo.doFunc(func() {
+			// A new session pings with the same timestamp it was created with, so
+			// equal times still count as pinging. Measure from now rather than from
+			// the last ping, since the pings themselves may have stopped.
+			if !sinfo.pingTime.Before(sinfo.time) && now.Sub(sinfo.time) > threshold {
+				unresponsive = append(unresponsive, sinfo)
+			}
+		})
+	}
+	return unresponsive
+}
+
 // Creates a new session and lazily cleans up old existing sessions. This
 // includse initializing session info to sane defaults (e.g. lowest supported
-// MTU).
-func (ss *sessions) createSession(theirPermKey *crypto.BoxPubKey) *sessionInfo {
+// MTU). The initiator flag is true if we're opening the session, or false if
+// it's in response to a session ping. Returns an error describing why if the
+// session was refused.
+func (ss *sessions) createSession(theirPermKey *crypto.BoxPubKey, initiator bool) (*sessionInfo, error) {
+	if ss.isFrozen {
+		// Existing sessions keep working, but we don't want any new ones
+		ss.frozenRefused++
+		ss.recordEstablishment(false)
+		return nil, errors.New("session creation is frozen")
+	}
+	if ss.maxHalfOpen > 0 && ss.halfOpen >= ss.maxHalfOpen {
+		// Don't let unresponsive nodes tie up more resources until some finish
+		ss.halfOpenRefused++
+		ss.recordEstablishment(false)
+		return nil, errors.New("too many half-open sessions")
+	}
+	if ss.maxSessions > 0 && len(ss.sinfos) >= ss.maxSessions {
+		if initiator {
+			// Sessions we open take priority over ones opened by remote nodes
+			ss.evictInbound()
+		}
+		if len(ss.sinfos) >= ss.maxSessions {
+			ss.recordEstablishment(false)
+			return nil, errors.New("too many sessions")
+		}
+	}
 	// TODO: this check definitely needs to be moved
-	if !ss.isSessionAllowed(theirPermKey, true) {
-		return nil
+	if !ss.isSessionAllowed(theirPermKey, initiator) {
+		ss.recordEstablishment(false)
+		return nil, errors.New("session not allowed")
 	}
 	sinfo := sessionInfo{}
 	sinfo.core = ss.core
 	sinfo.reconfigure = make(chan chan error, 1)
 	sinfo.theirPermPub = *theirPermKey
+	sinfo.isInbound = !initiator
 	pub, priv := crypto.NewBoxKeys()
 	sinfo.mySesPub = *pub
 	sinfo.mySesPriv = *priv
-	sinfo.myNonce = *crypto.NewBoxNonce()
-	sinfo.theirMTU = 1280
+	sinfo.nonceWindow = ss.nonceWindow
+	sinfo.nonceHeapSize = ss.nonceHeapSize
+	sinfo.staleKeyGrace = ss.staleKeyGrace
+	sinfo.keyRotateBytes = ss.keyRotateBytes
+	sinfo.theirMTU = minSessionMTU
+	handshakeTimeout := defaultHandshakeTimeout
 	ss.core.config.Mutex.RLock()
 	sinfo.myMTU = uint16(ss.core.config.Current.IfMTU)
+	if pin, isIn := ss.mtuPins[*theirPermKey]; isIn {
+		sinfo.myMTU = pin
+	}
+	sinfo.maxMTU = getMaxMTU(&ss.core.config.Current.SessionOptions)
+	sinfo.lastMTU = sinfo.getMTU()
+	// Don't accept pings older than the last one we saw before restarting
+	sinfo.tstamp = ss.tstamps[*theirPermKey]
+	sinfo.sendRateLimit = getSendRateLimit(&ss.core.config.Current.SessionOptions, theirPermKey)
+	sinfo.sendRateBurst = ss.core.config.Current.SessionOptions.SendRateBurst
+	sinfo.recvPktLimit = ss.core.config.Current.SessionOptions.RecvPacketLimit
+	sinfo.wantCompress = ss.core.config.Current.SessionOptions.Compression
+	sinfo.myCompress = sinfo.wantCompress
+	if t := ss.core.config.Current.SessionOptions.HandshakeTimeout; t > 0 {
+		handshakeTimeout = time.Duration(t) * time.Second
+	}
 	ss.core.config.Mutex.RUnlock()
-	now := time.Now()
+	now := ss.now()
 	sinfo.timeOpened = now
 	sinfo.time = now
 	sinfo.mtuTime = now
+	sinfo.oneWayTime = now
 	sinfo.pingTime = now
 	sinfo.pingSend = now
+	sinfo.keyTime = now
+	sinfo.rotate = make(chan struct{}, 1)
+	sinfo.features = make(map[string]bool)
 	sinfo.init = make(chan struct{})
 	sinfo.cancel = util.NewCancellation()
+	sinfo.resetMyNonce()
+	for attempt := 0; ; attempt++ {
+		if attempt == maxHandleAttempts {
+			ss.recordEstablishment(false)
+			return nil, errors.New("failed to generate an unused session handle")
+		}
+		sinfo.myHandle = *ss.newHandle(ss.handlePrefix)
+		if _, isIn := ss.sinfos[sinfo.myHandle]; !isIn {
+			break
+		}
+		// Overwriting the existing session would break it, so pick another handle
+		ss.core.log.Debugln("Session handle collision, generating a new handle")
+		sinfo.handleRetries++
+	}
+	sinfo.theirAddr = *address.AddrForNodeID(crypto.GetNodeID(&sinfo.theirPermPub))
+	sinfo.theirSubnet = *address.SubnetForNodeID(crypto.GetNodeID(&sinfo.theirPermPub))
+	sinfo.fromRouter = make(chan wire_trafficPacket, 1)
+	sinfo.recv = make(chan recvMessage, ss.recvBufferSize)
+	sinfo.send = make(chan FlowKeyMessage, ss.sendBufferSize)
+	ss.sinfos[sinfo.myHandle] = &sinfo
+	ss.byTheirPerm[sinfo.theirPermPub] = &sinfo.myHandle
+	ss.byTheirAddr[sinfo.theirAddr] = &sinfo.myHandle
+	ss.byTheirSubnet[sinfo.theirSubnet] = &sinfo.myHandle
+	ss.halfOpen++
+	go func() {
+		// Apply config changes until the session is canceled, then run cleanup
+		for {
+			select {
+			case e := <-sinfo.reconfigure:
+				current := sinfo.core.config.GetCurrent()
+				window, heapSize, _ := getNonceOptions(&current.SessionOptions)
+				grace := time.Duration(current.SessionOptions.StaleKeyGracePeriod) * time.Millisecond
+				rateLimit := getSendRateLimit(&current.SessionOptions, &sinfo.theirPermPub)
+				sinfo.doFunc(func() {
+					sinfo.setNonceOptions(window, heapSize)
+					sinfo.staleKeyGrace = grace
+					sinfo.keyRotateBytes = current.SessionOptions.KeyRotationBytes
+					sinfo.sendRateLimit = rateLimit
+					sinfo.sendRateBurst = current.SessionOptions.SendRateBurst
+					sinfo.recvPktLimit = current.SessionOptions.RecvPacketLimit
+					sinfo.maxMTU = getMaxMTU(&current.SessionOptions)
+					sinfo.checkMTU()
+					if compress := current.SessionOptions.Compression; compress != sinfo.wantCompress {
+						// New keys let the remote end know straight away, and tell
+						// it which packets have the marker
+						sinfo.wantCompress = compress
+						sinfo.requestRotate()
+					}
+				})
+				e <- nil
+			case <-sinfo.cancel.Finished():
+				sinfo.core.router.doAdmin(sinfo.close)
+				return
+			}
+		}
+	}()
+	go sinfo.startWorkers()
+	go sinfo.handshakeWorker(handshakeTimeout)
+	return &sinfo, nil
+}
+
+// Picks a new random nonce for sending, which is odd if our permanent key is
+// higher than theirs, or even otherwise, so the two ends never use the same one.
+func (sinfo *sessionInfo) resetMyNonce() {
+	sinfo.myNonce = *crypto.NewBoxNonce()
 	higher := false
-	for idx := range ss.core.boxPub {
-		if ss.core.boxPub[idx] > sinfo.theirPermPub[idx] {
+	for idx := range sinfo.core.boxPub {
+		if sinfo.core.boxPub[idx] > sinfo.theirPermPub[idx] {
 			higher = true
 			break
-		} else if ss.core.boxPub[idx] < sinfo.theirPermPub[idx] {
+		} else if sinfo.core.boxPub[idx] < sinfo.theirPermPub[idx] {
 			break
 		}
 	}
@@ -246,34 +970,140 @@ func (ss *sessions) createSession(theirPermKey *crypto.BoxPubKey) *sessionInfo {
 		// lower => even nonce
 		sinfo.myNonce[len(sinfo.myNonce)-1] &= 0xfe
 	}
-	sinfo.myHandle = *crypto.NewHandle()
-	sinfo.theirAddr = *address.AddrForNodeID(crypto.GetNodeID(&sinfo.theirPermPub))
-	sinfo.theirSubnet = *address.SubnetForNodeID(crypto.GetNodeID(&sinfo.theirPermPub))
-	sinfo.fromRouter = make(chan wire_trafficPacket, 1)
-	sinfo.recv = make(chan []byte, 32)
-	sinfo.send = make(chan FlowKeyMessage, 32)
-	ss.sinfos[sinfo.myHandle] = &sinfo
-	ss.byTheirPerm[sinfo.theirPermPub] = &sinfo.myHandle
-	go func() {
-		// Run cleanup when the session is canceled
-		<-sinfo.cancel.Finished()
-		sinfo.core.router.doAdmin(sinfo.close)
-	}()
-	go sinfo.startWorkers()
-	return &sinfo
+}
+
+// Closes any sessions which haven't received anything, not even a ping, for
+// longer than the configured idle timeout. Canceling the session stops its
+// workers and removes it from the maps, in the same way as any other close.
+// Called periodically from the router goroutine.
+func (ss *sessions) expireIdle() {
+	if ss.idleTimeout == 0 {
+		return
+	}
+	for _, sinfo := range ss.sinfos {
+		var isIdle bool
+		sinfo.doFunc(func() {
+			isIdle = ss.now().Sub(sinfo.time) > ss.idleTimeout
+		})
+		if isIdle {
+			sinfo.cancel.Cancel(errors.New("session idle timeout"))
+		}
+	}
+}
+
+// Flags any sessions which have sent plenty of traffic, but received none, in
+// the last oneWayWindow. Pings still get through in one direction or the other
+// when connectivity is half broken like this, so the session doesn't time out,
+// but the traffic is going nowhere. Packets are counted rather than comparing
+// nonces, because nonces start again when keys are rotated. Called periodically
+// from the router goroutine.
+func (ss *sessions) checkOneWay() {
+	now := ss.now()
+	for _, sinfo := range ss.sinfos {
+		sinfo.doFunc(func() {
+			if now.Sub(sinfo.oneWayTime) < oneWayWindow {
+				return
+			}
+			sent := sinfo.packetsSent - sinfo.oneWaySent
+			recvd := sinfo.packetsRecvd - sinfo.oneWayRecvd
+			isOneWay := sent >= oneWayMinPackets && recvd == 0
+			if isOneWay && !sinfo.isOneWay {
+				ss.core.log.Debugln("Session to", net.IP(sinfo.theirAddr[:]).String(), "is only carrying traffic one way")
+			}
+			sinfo.isOneWay = isOneWay
+			sinfo.oneWayTime = now
+			sinfo.oneWaySent, sinfo.oneWayRecvd = sinfo.packetsSent, sinfo.packetsRecvd
+		})
+	}
+}
+
+// Asks the send worker of any sessions which have used the same session keys
+// for longer than the configured interval to rotate them. Called periodically
+// from the router goroutine.
+func (ss *sessions) rotateKeys() {
+	if ss.keyRotation == 0 {
+		return
+	}
+	for _, sinfo := range ss.sinfos {
+		var isDue bool
+		sinfo.doFunc(func() {
+			isDue = ss.now().Sub(sinfo.keyTime) >= ss.keyRotation
+		})
+		if !isDue {
+			continue
+		}
+		select {
+		case <-sinfo.init:
+		default:
+			// Nothing to rotate until the handshake is done
+			continue
+		}
+		sinfo.requestRotate()
+	}
+}
+
+// Asks the send worker to rotate our session keys, if it hasn't been asked
+// already. Safe to call with or without the session mutex held.
+func (sinfo *sessionInfo) requestRotate() {
+	select {
+	case sinfo.rotate <- struct{}{}:
+	default:
+		// Already waiting to rotate
+	}
+}
+
+// Generates fresh session keys for our end of the session, for forward secrecy,
+// and sends a ping so that the remote end switches to them too. Packets from
+// the remote end under the old shared key are still accepted for a while, as
+// they can't switch until the ping arrives. The caller must hold the session
+// mutex, and should make sure anything already encrypted has been sent first.
+func (sinfo *sessionInfo) rotateKeys() {
+	grace := sinfo.staleKeyGrace
+	if grace < minKeyRotationGrace {
+		grace = minKeyRotationGrace
+	}
+	sinfo.retireSesKey(grace)
+	// Switching trace headers or compression on or off waits for new keys, so
+	// that the remote end can tell which packets have them
+	sinfo.myTraceIDs = sinfo.hasFeature(sessionFeatureTraceIDs)
+	sinfo.myCompress = sinfo.wantCompress
+	sinfo.theirNonce = crypto.BoxNonce{}
+	sinfo.theirNonceHeap = nil
+	sinfo.theirNonceMap = make(map[crypto.BoxNonce]time.Time)
+	pub, priv := crypto.NewBoxKeys()
+	sinfo.mySesPub = *pub
+	sinfo.mySesPriv = *priv
+	sinfo.sharedSesKey = *crypto.GetSharedKey(&sinfo.mySesPriv, &sinfo.theirSesPub)
+	sinfo.resetMyNonce()
+	sinfo.keyTime = sinfo.core.sessions.now()
+	sinfo.keyBytesSent = 0
+	sinfo.core.sessions.ping(sinfo)
+}
+
+// Moves the current shared key and the nonces received under it over to the
+// previous key, which is accepted for the given grace period. The caller must
+// hold the session mutex.
+func (sinfo *sessionInfo) retireSesKey(grace time.Duration) {
+	sinfo.prevSesKey = sinfo.sharedSesKey
+	sinfo.hasPrevSesKey = true
+	sinfo.prevKeyExpires = sinfo.core.sessions.now().Add(grace)
+	sinfo.prevNonce = sinfo.theirNonce
+	sinfo.prevNonceHeap = sinfo.theirNonceHeap
+	sinfo.prevNonceMap = sinfo.theirNonceMap
+	sinfo.prevTraceIDs = sinfo.theirTraceIDs
+	sinfo.prevCompress = sinfo.usesCompression()
 }
 
 func (ss *sessions) cleanup() {
 	// Time thresholds almost certainly could use some adjusting
-	for k := range ss.permShared {
-		// Delete a key, to make sure this eventually shrinks to 0
-		delete(ss.permShared, k)
-		break
-	}
-	if time.Since(ss.lastCleanup) < time.Minute {
+	ss.permSharedMutex.Lock()
+	defer ss.permSharedMutex.Unlock()
+	// Delete a key, to make sure this eventually shrinks to 0
+	ss.evictPermShared()
+	if ss.now().Sub(ss.lastCleanup) < time.Minute {
 		return
 	}
-	permShared := make(map[crypto.BoxPubKey]*crypto.BoxSharedKey, len(ss.permShared))
+	permShared := make(map[crypto.BoxPubKey]*permSharedEntry, len(ss.permShared))
 	for k, v := range ss.permShared {
 		permShared[k] = v
 	}
@@ -288,54 +1118,393 @@ func (ss *sessions) cleanup() {
 		byTheirPerm[k] = v
 	}
 	ss.byTheirPerm = byTheirPerm
-	ss.lastCleanup = time.Now()
+	byTheirAddr := make(map[address.Address]*crypto.Handle, len(ss.byTheirAddr))
+	for k, v := range ss.byTheirAddr {
+		byTheirAddr[k] = v
+	}
+	ss.byTheirAddr = byTheirAddr
+	byTheirSubnet := make(map[address.Subnet]*crypto.Handle, len(ss.byTheirSubnet))
+	for k, v := range ss.byTheirSubnet {
+		byTheirSubnet[k] = v
+	}
+	ss.byTheirSubnet = byTheirSubnet
+	ss.lastCleanup = ss.now()
 }
 
-// Closes a session, removing it from sessions maps.
-func (sinfo *sessionInfo) close() {
-	if s := sinfo.core.sessions.sinfos[sinfo.myHandle]; s == sinfo {
-		delete(sinfo.core.sessions.sinfos, sinfo.myHandle)
-		delete(sinfo.core.sessions.byTheirPerm, sinfo.theirPermPub)
+// Forcibly tears down the session with the given permanent key, if there is
+// one, returning true if a session was found. The session is removed from the
+// maps straight away, and canceling it stops the workers and any Conn using it.
+func (ss *sessions) removeSession(pubkey *crypto.BoxPubKey) bool {
+	sinfo, isIn := ss.getByTheirPerm(pubkey)
+	if !isIn {
+		return false
 	}
+	sinfo.close()
+	sinfo.cancel.Cancel(errors.New("session removed"))
+	return true
 }
 
-// Returns a session ping appropriate for the given session info.
-func (ss *sessions) getPing(sinfo *sessionInfo) sessionPing {
-	loc := ss.core.switchTable.getLocator()
-	coords := loc.getCoords()
-	ref := sessionPing{
-		SendPermPub: ss.core.boxPub,
-		Handle:      sinfo.myHandle,
-		SendSesPub:  sinfo.mySesPub,
-		Tstamp:      time.Now().Unix(),
-		Coords:      coords,
-		MTU:         sinfo.myMTU,
-	}
+// Closes the session opened by a remote node which has gone the longest without
+// receiving anything, to make room for a new session, if there are any.
+func (ss *sessions) evictInbound() {
+	var victim *sessionInfo
+	var victimTime time.Time
+	for _, sinfo := range ss.sinfos {
+		if !sinfo.isInbound {
+			continue
+		}
+		var lastRecvd time.Time
+		sinfo.doFunc(func() { lastRecvd = sinfo.time })
+		if victim == nil || lastRecvd.Before(victimTime) {
+			victim, victimTime = sinfo, lastRecvd
+		}
+	}
+	if victim == nil {
+		return
+	}
+	ss.core.log.Debugln("Evicting session to", net.IP(victim.theirAddr[:]).String(), "to make room for a new session")
+	victim.close()
+	victim.cancel.Cancel(errors.New("session evicted"))
+}
+
+// Cancels the session if it hasn't finished its handshake yet, e.g. because
+// whoever was waiting for it gave up. Returns true, without canceling it, if
+// the session is already open, since others may be using it by then.
+func (sinfo *sessionInfo) cancelIfNotReady(reason error) bool {
+	isReady := false
+	sinfo.doFunc(func() {
+		// update closes init with the mutex held, so this can't race with it
+		select {
+		case <-sinfo.init:
+			isReady = true
+		default:
+			sinfo.cancel.Cancel(reason)
+		}
+	})
+	return isReady
+}
+
+// Closes a session, removing it from sessions maps.
+func (sinfo *sessionInfo) close() {
+	ss := &sinfo.core.sessions
+	if s := ss.sinfos[sinfo.myHandle]; s == sinfo {
+		delete(ss.sinfos, sinfo.myHandle)
+		// Another session with the same node may have replaced this one in the
+		// indexes, in which case its entries have to stay
+		if h, isIn := ss.byTheirPerm[sinfo.theirPermPub]; isIn && *h == sinfo.myHandle {
+			delete(ss.byTheirPerm, sinfo.theirPermPub)
+		}
+		if h, isIn := ss.byTheirAddr[sinfo.theirAddr]; isIn && *h == sinfo.myHandle {
+			delete(ss.byTheirAddr, sinfo.theirAddr)
+		}
+		if h, isIn := ss.byTheirSubnet[sinfo.theirSubnet]; isIn && *h == sinfo.myHandle {
+			delete(ss.byTheirSubnet, sinfo.theirSubnet)
+		}
+		ss.rememberTstamp(sinfo)
+		// Keep the node-wide totals from going backwards
+		sinfo.doFunc(func() {
+			ss.closedTotals.add(sinfo)
+		})
+		select {
+		case <-sinfo.init:
+			if sinfo.cancel.Error() != errSessionClosedRemotely {
+				// Let the remote end know, rather than leaving it to time out
+				sinfo.doFunc(func() {
+					ss.sendClose(sinfo)
+				})
+			}
+			// Only sessions that were announced as open are announced as closed
+			ss.sendEvent(SessionClosed, sinfo)
+		default:
+			// The session never finished initializing, e.g. the handshake timed out
+			ss.halfOpen--
+			ss.recordEstablishment(false)
+		}
+	}
+}
+
+// Loads the tstamps saved in tstampStore, replacing any that were loaded
+// before, or stops keeping tstamps if tstampStore isn't set. If the file is
+// missing or can't be read, we start again with no tstamps, which is the same
+// as not having a store at all until the first tstamps are saved.
+func (ss *sessions) loadTstamps() {
+	ss.tstampsDirty = false
+	if ss.tstampStore == "" {
+		ss.tstamps = nil
+		return
+	}
+	ss.tstamps = make(map[crypto.BoxPubKey]int64)
+	bs, err := ioutil.ReadFile(ss.tstampStore)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			ss.core.log.Warnln("Failed to read session timestamp store:", err)
+		}
+		return
+	}
+	var saved map[string]int64
+	if err := json.Unmarshal(bs, &saved); err != nil {
+		ss.core.log.Warnln("Ignoring corrupt session timestamp store:", err)
+		return
+	}
+	for hexKey, tstamp := range saved {
+		kbs, err := hex.DecodeString(hexKey)
+		if err != nil || len(kbs) != crypto.BoxPubKeyLen {
+			ss.core.log.Warnln("Ignoring invalid key in session timestamp store:", hexKey)
+			continue
+		}
+		var key crypto.BoxPubKey
+		copy(key[:], kbs)
+		ss.tstamps[key] = tstamp
+	}
+	ss.pruneTstamps()
+}
+
+// Forgets the oldest tstamps once there are more than maxStoredTstamps, so the
+// store doesn't grow without bound as we hear from more nodes. Sessions which
+// are still open keep their own tstamp, and it's remembered again when they
+// next save or close.
+func (ss *sessions) pruneTstamps() {
+	if len(ss.tstamps) <= maxStoredTstamps {
+		return
+	}
+	keys := make([]crypto.BoxPubKey, 0, len(ss.tstamps))
+	for key := range ss.tstamps {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return ss.tstamps[keys[i]] > ss.tstamps[keys[j]] })
+	for _, key := range keys[maxStoredTstamps:] {
+		delete(ss.tstamps, key)
+	}
+	ss.tstampsDirty = true
+}
+
+// Saves the tstamps to tstampStore. The file is replaced rather than written
+// in place, so that it isn't left corrupt if the node stops part way through.
+func (ss *sessions) saveTstamps() {
+	ss.pruneTstamps()
+	saved := make(map[string]int64, len(ss.tstamps))
+	for key, tstamp := range ss.tstamps {
+		saved[hex.EncodeToString(key[:])] = tstamp
+	}
+	bs, err := json.Marshal(saved)
+	if err == nil {
+		tmp := ss.tstampStore + ".tmp"
+		if err = ioutil.WriteFile(tmp, bs, 0600); err == nil {
+			err = os.Rename(tmp, ss.tstampStore)
+		}
+	}
+	if err != nil {
+		ss.core.log.Warnln("Failed to save session timestamp store:", err)
+	}
+	ss.tstampsDirty = false
+	ss.tstampsSaved = ss.now()
+}
+
+// Records the tstamp of the last ping accepted by a session, if we're keeping
+// tstamps.
+func (ss *sessions) rememberTstamp(sinfo *sessionInfo) {
+	if ss.tstamps == nil {
+		return
+	}
+	if tstamp := atomic.LoadInt64(&sinfo.tstamp); tstamp > ss.tstamps[sinfo.theirPermPub] {
+		ss.tstamps[sinfo.theirPermPub] = tstamp
+		ss.tstampsDirty = true
+	}
+}
+
+// Periodically saves the tstamps of open sessions, if we're keeping tstamps.
+// Saves are spaced out by tstampSaveInterval, so the file isn't rewritten
+// every time a session is pinged.
+func (ss *sessions) saveTstampsIfNeeded() {
+	if ss.tstamps == nil || ss.now().Sub(ss.tstampsSaved) < tstampSaveInterval {
+		return
+	}
+	for _, sinfo := range ss.sinfos {
+		ss.rememberTstamp(sinfo)
+	}
+	if ss.tstampsDirty {
+		ss.saveTstamps()
+	}
+}
+
+// Adds a channel to be notified when sessions open or close.
+func (ss *sessions) addEventListener(ch chan<- SessionEvent) {
+	ss.eventListeners = append(ss.eventListeners, ch)
+}
+
+// Stops notifying a channel that was added by addEventListener.
+func (ss *sessions) removeEventListener(ch chan<- SessionEvent) {
+	for idx, listener := range ss.eventListeners {
+		if listener == ch {
+			ss.eventListeners = append(ss.eventListeners[:idx], ss.eventListeners[idx+1:]...)
+			return
+		}
+	}
+}
+
+// Notifies every listener that a session has opened or closed. This must be
+// called without the session mutex held. It's called from the router goroutine,
+// so the event is dropped rather than blocking if a listener isn't ready for it.
+func (ss *sessions) sendEvent(eventType SessionEventType, sinfo *sessionInfo) {
+	event := SessionEvent{
+		Type:      eventType,
+		PublicKey: sinfo.theirPermPub,
+		Address:   sinfo.theirAddr,
+	}
+	for _, ch := range ss.eventListeners {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Records the outcome of an attempt to establish a session.
+func (ss *sessions) recordEstablishment(succeeded bool) {
+	minute := ss.now().Unix() / 60
+	bucket := &ss.establishments[minute%establishmentBuckets]
+	if bucket.minute != minute {
+		// This bucket is left over from an earlier window, so start again
+		*bucket = establishmentBucket{minute: minute}
+	}
+	if succeeded {
+		bucket.succeeded++
+	} else {
+		bucket.failed++
+	}
+}
+
+// Gets the number of session establishment attempts that succeeded or failed
+// within the last establishmentBuckets minutes.
+func (ss *sessions) getEstablishments() (succeeded uint64, failed uint64) {
+	minute := ss.now().Unix() / 60
+	for _, bucket := range ss.establishments {
+		if minute-bucket.minute < establishmentBuckets {
+			succeeded += bucket.succeeded
+			failed += bucket.failed
+		}
+	}
+	return
+}
+
+// Returns a session ping appropriate for the given session info.
+func (ss *sessions) getPing(sinfo *sessionInfo) sessionPing {
+	loc := ss.core.switchTable.getLocator()
+	coords := loc.getCoords()
+	ref := sessionPing{
+		SendPermPub: ss.core.boxPub,
+		Handle:      sinfo.myHandle,
+		SendSesPub:  sinfo.mySesPub,
+		Tstamp:      sinfo.nextTstamp(),
+		Coords:      coords,
+		MTU:         sinfo.myMTU,
+		Compression: sinfo.myCompress,
+		TraceIDs:    sinfo.myTraceIDs,
+	}
 	sinfo.myNonce.Increment()
+	if sinfo.myNonce.NearMax() {
+		// Rotating keys resets the nonce, so it never wraps around
+		sinfo.requestRotate()
+	}
 	return ref
 }
 
+// Returns the tstamp for the next ping or close that we send, which is the
+// current unix time, unless we've already sent one this second. The remote end
+// rejects anything that isn't newer than the last, as it could be a replay, so
+// e.g. rotating keys straight after the handshake would otherwise be ignored.
+// The caller must hold the session mutex.
+func (sinfo *sessionInfo) nextTstamp() int64 {
+	tstamp := sinfo.core.sessions.now().Unix()
+	if tstamp <= sinfo.myTstamp {
+		tstamp = sinfo.myTstamp + 1
+	}
+	sinfo.myTstamp = tstamp
+	return tstamp
+}
+
 // Gets the shared key for a pair of box keys.
 // Used to cache recently used shared keys for protocol traffic.
 // This comes up with dht req/res and session ping/pong traffic.
+// Safe to call from any goroutine, the cache is protected by permSharedMutex.
 func (ss *sessions) getSharedKey(myPriv *crypto.BoxPrivKey,
 	theirPub *crypto.BoxPubKey) *crypto.BoxSharedKey {
-	return crypto.GetSharedKey(myPriv, theirPub)
-	// FIXME concurrency issues with the below, so for now we just burn the CPU every time
-	if skey, isIn := ss.permShared[*theirPub]; isIn {
-		return skey
+	ss.permSharedMutex.Lock()
+	entry, isIn := ss.permShared[*theirPub]
+	if isIn {
+		entry.lastUsed = ss.now()
+	}
+	ss.permSharedMutex.Unlock()
+	if isIn {
+		return entry.key
 	}
+	// Don't hold the mutex while doing the expensive part
+	// If two goroutines race to here, they just both compute the same key
+	skey := crypto.GetSharedKey(myPriv, theirPub)
+	ss.permSharedMutex.Lock()
+	defer ss.permSharedMutex.Unlock()
 	// First do some cleanup
 	const maxKeys = 1024
-	for key := range ss.permShared {
-		// Remove a random key until the store is small enough
-		if len(ss.permShared) < maxKeys {
-			break
+	for len(ss.permShared) >= maxKeys {
+		// Remove the least recently used key until the store is small enough
+		ss.evictPermShared()
+	}
+	ss.permShared[*theirPub] = &permSharedEntry{key: skey, lastUsed: ss.now()}
+	return skey
+}
+
+// Gets the node that a flow was last connected to by Dialer.DialFlow, if it's
+// still remembered, and marks the flow as recently used.
+func (ss *sessions) getFlowAffinity(flowKey uint64) (crypto.NodeID, bool) {
+	entry, isIn := ss.flowAffinity[flowKey]
+	if !isIn {
+		return crypto.NodeID{}, false
+	}
+	entry.lastUsed = ss.now()
+	return entry.node, true
+}
+
+// Remembers the node that a flow is connected to, forgetting the least recently
+// used flow first if there are already too many.
+func (ss *sessions) setFlowAffinity(flowKey uint64, node crypto.NodeID) {
+	if _, isIn := ss.flowAffinity[flowKey]; !isIn && len(ss.flowAffinity) >= maxFlowAffinities {
+		var oldest uint64
+		var oldestEntry *flowAffinityEntry
+		for k, entry := range ss.flowAffinity {
+			if oldestEntry == nil || entry.lastUsed.Before(oldestEntry.lastUsed) {
+				oldest, oldestEntry = k, entry
+			}
+		}
+		delete(ss.flowAffinity, oldest)
+	}
+	ss.flowAffinity[flowKey] = &flowAffinityEntry{node: node, lastUsed: ss.now()}
+}
+
+// Removes the least recently used key from the shared key cache, so that the
+// keys of nodes we talk to often (e.g. DHT neighbours) aren't thrown away. The
+// caller must hold permSharedMutex.
+func (ss *sessions) evictPermShared() {
+	var oldest crypto.BoxPubKey
+	var oldestEntry *permSharedEntry
+	for k, entry := range ss.permShared {
+		if oldestEntry == nil || entry.lastUsed.Before(oldestEntry.lastUsed) {
+			oldest, oldestEntry = k, entry
 		}
-		delete(ss.permShared, key)
 	}
-	ss.permShared[*theirPub] = crypto.GetSharedKey(myPriv, theirPub)
-	return ss.permShared[*theirPub]
+	if oldestEntry != nil {
+		delete(ss.permShared, oldest)
+	}
+}
+
+// Empties the shared key cache, so that every shared key is derived again the
+// next time it's needed, and returns the number of keys that were removed.
+// Safe to call from any goroutine.
+func (ss *sessions) flushPermShared() int {
+	ss.permSharedMutex.Lock()
+	defer ss.permSharedMutex.Unlock()
+	flushed := len(ss.permShared)
+	ss.permShared = make(map[crypto.BoxPubKey]*permSharedEntry)
+	return flushed
 }
 
 // Sends a session ping by calling sendPingPong in ping mode.
@@ -360,8 +1529,68 @@ func (ss *sessions) sendPingPong(sinfo *sessionInfo, isPong bool) {
 	}
 	packet := p.encode()
 	ss.core.router.out(packet)
+	now := ss.now()
 	if sinfo.pingTime.Before(sinfo.time) {
-		sinfo.pingTime = time.Now()
+		sinfo.pingTime = now
+	}
+	if !isPong {
+		// Used to measure latency when the pong comes back
+		sinfo.pingSend = now
+		sinfo.pingsPending++
+	}
+}
+
+// Sends a best-effort notification to the remote end that the session is
+// closing. The caller must hold the session mutex.
+func (ss *sessions) sendClose(sinfo *sessionInfo) {
+	msg := sessionClose{
+		Handle: sinfo.myHandle,
+		Tstamp: sinfo.nextTstamp(),
+	}
+	bs := msg.encode()
+	shared := ss.getSharedKey(&ss.core.boxPriv, &sinfo.theirPermPub)
+	payload, nonce := crypto.BoxSeal(shared, bs, nil)
+	p := wire_protoTrafficPacket{
+		Coords:  sinfo.coords,
+		ToKey:   sinfo.theirPermPub,
+		FromKey: ss.core.boxPub,
+		Nonce:   *nonce,
+		Payload: payload,
+	}
+	packet := p.encode()
+	ss.core.router.out(packet)
+}
+
+// Handles a session close notification, tearing down the matching session.
+// The handle has to match the one from the remote end's pings, so a close for
+// an older session with the same node can't affect the current one.
+func (ss *sessions) handleClose(msg *sessionClose) {
+	sinfo, isIn := ss.getByTheirPerm(&msg.SendPermPub)
+	if !isIn {
+		return
+	}
+	var isOK bool
+	sinfo.doFunc(func() {
+		// Closes take their tstamp from the same counter as pings, so a close
+		// is always newer than the last ping from the same session
+		isOK = msg.Handle == sinfo.theirHandle && msg.Tstamp > atomic.LoadInt64(&sinfo.tstamp)
+	})
+	if !isOK {
+		return
+	}
+	sinfo.cancel.Cancel(errSessionClosedRemotely)
+	sinfo.close()
+}
+
+// Closes every session, e.g. when the node is stopping, so that the remote ends
+// are told about it.
+func (ss *sessions) closeAll() {
+	for _, sinfo := range ss.sinfos {
+		sinfo.close()
+		sinfo.cancel.Cancel(errors.New("node stopped"))
+	}
+	if ss.tstampsDirty {
+		ss.saveTstamps()
 	}
 }
 
@@ -379,43 +1608,142 @@ func (ss *sessions) handlePing(ping *sessionPing) {
 		if ss.listener != nil {
 			// This is a ping from an allowed node for which no session exists, and we have a listener ready to handle sessions.
 			// We need to create a session and pass it to the listener.
-			sinfo = ss.createSession(&ping.SendPermPub)
-			if s, _ := ss.getByTheirPerm(&ping.SendPermPub); s != sinfo {
-				panic("This should not happen")
-			}
-			conn := newConn(ss.core, crypto.GetNodeID(&sinfo.theirPermPub), &crypto.NodeID{}, sinfo)
-			for i := range conn.nodeMask {
-				conn.nodeMask[i] = 0xFF
+			var err error
+			if sinfo, err = ss.createSession(&ping.SendPermPub, false); err != nil {
+				ss.core.log.Debugln("Refused incoming session:", err)
+			} else {
+				conn := newConn(ss.core, crypto.GetNodeID(&sinfo.theirPermPub), &crypto.NodeID{}, sinfo)
+				for i := range conn.nodeMask {
+					conn.nodeMask[i] = 0xFF
+				}
+				c := ss.listener.conn
+				go func() { c <- conn }()
 			}
-			c := ss.listener.conn
-			go func() { c <- conn }()
 		}
 		ss.listenerMutex.Unlock()
 	}
 	if sinfo != nil {
+		var isOpened bool // This ping finished the handshake
 		sinfo.doFunc(func() {
+			select {
+			case <-sinfo.init:
+			default:
+				isOpened = true
+			}
 			// Update the session
-			if !sinfo.update(ping) { /*panic("Should not happen in testing")*/
+			result := sinfo.update(ping)
+			sinfo.pingResults[result]++
+			if result != pingAccepted {
+				isOpened = false
+				sinfo.lastPingReject = result
+				if result == pingHandleCollision {
+					sinfo.core.log.Warnln("Rejected session ping from", hex.EncodeToString(ping.SendPermPub[:]), "for a session with a colliding handle")
+				}
 				return
 			}
-			if !ping.IsPong {
+			if ping.IsPong {
+				sinfo.updateLatency()
+			} else {
 				ss.sendPingPong(sinfo, true)
 			}
 		})
+		if isOpened {
+			// Done without the session mutex held, so that nothing waiting on the
+			// session can hold up the event listeners, or the other way around
+			ss.halfOpen--
+			ss.recordEstablishment(true)
+			ss.sendEvent(SessionOpened, sinfo)
+		}
+	}
+}
+
+// Returns the name of the reason that update last rejected a ping for, or ""
+// if it has never rejected one. The caller must hold the session mutex.
+func (sinfo *sessionInfo) getLastPingReject() string {
+	if sinfo.lastPingReject == pingAccepted {
+		return ""
+	}
+	return sessionPingResultNames[sinfo.lastPingReject]
+}
+
+// Updates the smoothed round-trip time of the session, in response to a pong
+// which has already been accepted by update, so replayed pongs never get here.
+// The caller must hold the session mutex.
+func (sinfo *sessionInfo) updateLatency() {
+	pending := sinfo.pingsPending
+	sinfo.pingsPending = 0
+	switch {
+	case pending == 0:
+		// This pong doesn't match a ping that we sent, so we can't time it
+		return
+	case pending > 1:
+		// Pongs don't say which ping they're for, so if several were sent (e.g.
+		// handshake retries) then this could be a reply to any of them
+		return
+	}
+	rtt := sinfo.core.sessions.now().Sub(sinfo.pingSend)
+	if sinfo.latency == 0 {
+		sinfo.latency = rtt
+	} else {
+		// Exponentially weighted moving average, as in RFC 6298
+		sinfo.latency += (rtt - sinfo.latency) / 8
 	}
 }
 
 // Get the MTU of the session.
-// Will be equal to the smaller of this node's MTU or the remote node's MTU.
+// Will be equal to the smaller of this node's MTU or the remote node's MTU, capped at the configured maximum (if any).
 // If sending over links with a maximum message size (this was a thing with the old UDP code), it could be further lowered, to a minimum of 1280.
 func (sinfo *sessionInfo) getMTU() uint16 {
 	if sinfo.theirMTU == 0 || sinfo.myMTU == 0 {
 		return 0
 	}
-	if sinfo.theirMTU < sinfo.myMTU {
-		return sinfo.theirMTU
+	mtu := sinfo.myMTU
+	if sinfo.theirMTU < mtu {
+		mtu = sinfo.theirMTU
+	}
+	if sinfo.maxMTU > 0 && sinfo.maxMTU < mtu {
+		mtu = sinfo.maxMTU
+	}
+	return mtu
+}
+
+// Sets the MTU that we advertise to the given node, instead of IfMTU, or goes
+// back to using IfMTU if the MTU is 0. This applies to any open session with
+// the node straight away, and the remote end is pinged so that it finds out,
+// as well as to any sessions opened with the node later.
+func (ss *sessions) setMTUPin(key *crypto.BoxPubKey, mtu uint16) {
+	if mtu == 0 {
+		delete(ss.mtuPins, *key)
+		mtu = uint16(ss.core.config.GetCurrent().IfMTU)
+	} else {
+		ss.mtuPins[*key] = mtu
+	}
+	if sinfo, isIn := ss.getByTheirPerm(key); isIn {
+		sinfo.doFunc(func() {
+			if sinfo.myMTU != mtu {
+				sinfo.myMTU = mtu
+				sinfo.checkMTU()
+				ss.ping(sinfo)
+			}
+		})
+	}
+}
+
+// Calls the MTU handler, if there is one, if the result of getMTU has changed
+// since it was last called. This must be called with the session mutex held,
+// after changing anything that getMTU depends on.
+func (sinfo *sessionInfo) checkMTU() {
+	mtu := sinfo.getMTU()
+	if mtu == sinfo.lastMTU {
+		return
+	}
+	sinfo.lastMTU = mtu
+	sinfo.core.sessions.mtuHandlerMutex.RLock()
+	handler := sinfo.core.sessions.mtuHandler
+	sinfo.core.sessions.mtuHandlerMutex.RUnlock()
+	if handler != nil {
+		handler(sinfo.theirAddr, mtu)
 	}
-	return sinfo.myMTU
 }
 
 // Checks if a packet's nonce is recent enough to fall within the window of allowed packets, and not already received.
@@ -425,6 +1753,10 @@ func (sinfo *sessionInfo) nonceIsOK(theirNonce *crypto.BoxNonce) bool {
 		// This is newer than the newest nonce we've seen
 		return true
 	}
+	if sinfo.hasFeature(sessionFeatureStrictOrdering) {
+		// Anything that arrives out of order is dropped
+		return false
+	}
 	if len(sinfo.theirNonceHeap) > 0 {
 		if theirNonce.Minus(sinfo.theirNonceHeap.peek()) > 0 {
 			if _, isIn := sinfo.theirNonceMap[*theirNonce]; !isIn {
@@ -436,11 +1768,23 @@ func (sinfo *sessionInfo) nonceIsOK(theirNonce *crypto.BoxNonce) bool {
 	return false
 }
 
+// Changes how many old nonces the session keeps track of, and for how long.
+// If the heap is now bigger than allowed, then the oldest nonces are dropped
+// straight away, rather than waiting for the next call to updateNonce.
+func (sinfo *sessionInfo) setNonceOptions(window time.Duration, heapSize int) {
+	sinfo.nonceWindow = window
+	sinfo.nonceHeapSize = heapSize
+	for len(sinfo.theirNonceHeap) > sinfo.nonceHeapSize {
+		delete(sinfo.theirNonceMap, *sinfo.theirNonceHeap.peek())
+		heap.Pop(&sinfo.theirNonceHeap)
+	}
+}
+
 // Updates the nonce mask by (possibly) shifting the bitmask and setting the bit corresponding to this nonce to 1, and then updating the most recent nonce
 func (sinfo *sessionInfo) updateNonce(theirNonce *crypto.BoxNonce) {
 	// Start with some cleanup
-	for len(sinfo.theirNonceHeap) > 64 {
-		if time.Since(sinfo.theirNonceMap[*sinfo.theirNonceHeap.peek()]) < nonceWindow {
+	for len(sinfo.theirNonceHeap) > sinfo.nonceHeapSize {
+		if sinfo.core.sessions.now().Sub(sinfo.theirNonceMap[*sinfo.theirNonceHeap.peek()]) < sinfo.nonceWindow {
 			// This nonce is still fairly new, so keep it around
 			break
 		}
@@ -448,13 +1792,70 @@ func (sinfo *sessionInfo) updateNonce(theirNonce *crypto.BoxNonce) {
 		delete(sinfo.theirNonceMap, *sinfo.theirNonceHeap.peek())
 		heap.Pop(&sinfo.theirNonceHeap)
 	}
+	for len(sinfo.theirNonceHeap) >= maxTrackedNonces {
+		// Too many nonces are being tracked, so forget the oldest even though
+		// they're still in the window, which means that very late packets may
+		// be dropped until the burst has passed
+		delete(sinfo.theirNonceMap, *sinfo.theirNonceHeap.peek())
+		heap.Pop(&sinfo.theirNonceHeap)
+	}
 	if theirNonce.Minus(&sinfo.theirNonce) > 0 {
 		// This nonce is the newest we've seen, so make a note of that
 		sinfo.theirNonce = *theirNonce
+	} else {
+		// This was let through by the heap, so it arrived out of order
+		sinfo.reordered++
 	}
 	// Add it to the heap/map so we know not to allow it again
 	heap.Push(&sinfo.theirNonceHeap, *theirNonce)
-	sinfo.theirNonceMap[*theirNonce] = time.Now()
+	sinfo.theirNonceMap[*theirNonce] = sinfo.core.sessions.now()
+}
+
+// Checks if a packet's nonce is OK to accept under the previous session key,
+// in the same way as nonceIsOK. Nothing is OK once the grace window has passed,
+// so that we don't spend any more time trying to decrypt with the old key.
+func (sinfo *sessionInfo) prevNonceIsOK(theirNonce *crypto.BoxNonce) bool {
+	if sinfo.prevNonceMap == nil {
+		return false
+	}
+	if theirNonce.Minus(&sinfo.prevNonce) > 0 {
+		return true
+	}
+	if len(sinfo.prevNonceHeap) > 0 {
+		if theirNonce.Minus(sinfo.prevNonceHeap.peek()) > 0 {
+			_, isIn := sinfo.prevNonceMap[*theirNonce]
+			return !isIn
+		}
+	}
+	return false
+}
+
+// Like updateNonce, but for packets accepted under the previous session key.
+// These nonces only need remembering until the grace window ends, so they are
+// only limited by the heap size.
+func (sinfo *sessionInfo) updatePrevNonce(theirNonce *crypto.BoxNonce) {
+	for len(sinfo.prevNonceHeap) > sinfo.nonceHeapSize {
+		delete(sinfo.prevNonceMap, *sinfo.prevNonceHeap.peek())
+		heap.Pop(&sinfo.prevNonceHeap)
+	}
+	if theirNonce.Minus(&sinfo.prevNonce) > 0 {
+		sinfo.prevNonce = *theirNonce
+	}
+	heap.Push(&sinfo.prevNonceHeap, *theirNonce)
+	sinfo.prevNonceMap[*theirNonce] = sinfo.core.sessions.now()
+}
+
+// Forgets the previous session key, and the nonces tracked for it, once its
+// grace window has ended. Otherwise every packet that fails to decrypt would be
+// tried against the old key too, which a remote node could use to make us do
+// twice the work.
+func (sinfo *sessionInfo) expirePrevKey() {
+	if sinfo.hasPrevSesKey && sinfo.core.sessions.now().After(sinfo.prevKeyExpires) {
+		sinfo.prevSesKey = crypto.BoxSharedKey{}
+		sinfo.hasPrevSesKey = false
+		sinfo.prevNonceHeap = nil
+		sinfo.prevNonceMap = nil
+	}
 }
 
 // Resets all sessions to an uninitialized state.
@@ -476,88 +1877,389 @@ func (sinfo *sessionInfo) startWorkers() {
 	go sinfo.sendWorker()
 }
 
+// Waits for the session to finish initializing, re-sending session pings with
+// an exponential backoff in the mean time. If the handshake hasn't completed by
+// the time the deadline is reached, then the session is canceled with a timeout
+// error, which is passed back to anyone waiting to dial it.
+func (sinfo *sessionInfo) handshakeWorker(timeout time.Duration) {
+	// The timers only wake us up, whether the handshake has timed out is up to
+	// the session clock
+	deadlineAt := sinfo.core.sessions.now().Add(timeout)
+	deadline := time.NewTimer(timeout)
+	defer util.TimerStop(deadline)
+	interval := time.Second
+	retry := time.NewTimer(interval)
+	defer util.TimerStop(retry)
+	for {
+		select {
+		case <-sinfo.init:
+			return
+		case <-sinfo.cancel.Finished():
+			return
+		case <-deadline.C:
+		case <-retry.C:
+			sinfo.doFunc(func() {
+				sinfo.core.sessions.ping(sinfo)
+			})
+			interval *= 2
+			retry.Reset(interval)
+		}
+		if !sinfo.core.sessions.now().Before(deadlineAt) {
+			sinfo.cancel.Cancel(util.CancellationTimeoutError)
+			return
+		}
+	}
+}
+
+// A packet to be sent by a session, as passed to Conn.WriteNoCopy. If FlowKey
+// is not 0, then it's appended to the coords of the packet, so that switches
+// along the path queue it separately from other flows to the same node, and
+// the session's send worker keeps it in order with the rest of the flow. If
+// FlowKey is 0, then no extra coords are added, and the packet shares a queue
+// with all other unkeyed traffic to the same node.
 type FlowKeyMessage struct {
 	FlowKey uint64
+	TraceID uint64 // Sent with the packet if the session has trace IDs enabled, 0 for none
 	Message []byte
 }
 
+// A decrypted packet waiting for Conn.Read, along with its trace ID, if any.
+type recvMessage struct {
+	traceID uint64
+	message []byte
+}
+
+// Returns a copy of the message with a trace header in front, for sessions
+// with the trace_ids feature enabled. The original message is freed.
+func putTraceHeader(msg FlowKeyMessage) []byte {
+	out := util.GetBytes()
+	if msg.TraceID == 0 {
+		out = append(out, 0)
+	} else {
+		var id [8]byte
+		binary.BigEndian.PutUint64(id[:], msg.TraceID)
+		out = append(append(out, 1), id[:]...)
+	}
+	out = append(out, msg.Message...)
+	util.PutBytes(msg.Message)
+	return out
+}
+
+// Removes the trace header from the front of a received packet, in place, and
+// returns the trace ID, or 0 if there wasn't one. Returns false if the packet
+// doesn't start with a valid header, in which case it's returned untouched.
+func takeTraceHeader(bs []byte) ([]byte, uint64, bool) {
+	var headerLen int
+	var traceID uint64
+	switch {
+	case len(bs) >= 1 && bs[0] == 0:
+		headerLen = 1
+	case len(bs) >= traceHeaderLen && bs[0] == 1:
+		headerLen = traceHeaderLen
+		traceID = binary.BigEndian.Uint64(bs[1:traceHeaderLen])
+	default:
+		return bs, 0, false
+	}
+	copy(bs, bs[headerLen:])
+	return bs[:len(bs)-headerLen], traceID, true
+}
+
+// Returns how many bytes of each packet are used by headers in front of the
+// message, which the message has to leave room for to fit in the MTU. The
+// caller must hold the session mutex.
+func (sinfo *sessionInfo) headerLen() uint16 {
+	var n uint16
+	if sinfo.myTraceIDs {
+		n += traceHeaderLen
+	}
+	if sinfo.usesCompression() {
+		n++
+	}
+	return n
+}
+
+// Returns true if packets under the current session keys have a compression
+// marker, which is only the case if both ends advertised compression with their
+// keys. Nodes that don't know about compression never advertise it, so they're
+// never sent a marker that they wouldn't know to remove. The caller must hold
+// the session mutex.
+func (sinfo *sessionInfo) usesCompression() bool {
+	return sinfo.myCompress && sinfo.theirCompress
+}
+
+// Writers and readers are expensive to set up, so they're reused
+var flateWriters = sync.Pool{New: func() interface{} {
+	w, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return w
+}}
+var flateReaders = sync.Pool{New: func() interface{} {
+	return flate.NewReader(bytes.NewReader(nil))
+}}
+
+// Returns a compressed copy of the packet, with a marker in front, for session
+// keys that both ends advertised with compression. If the packet is too short to
+// be worth compressing, or compressing doesn't make it smaller, then it's sent
+// as-is after the marker instead, so it never gets more than one byte bigger.
+// The original packet is freed.
+func compressPacket(bs []byte) []byte {
+	if len(bs) < minCompressLen {
+		out := append(append(util.GetBytes(), compressNone), bs...)
+		util.PutBytes(bs)
+		return out
+	}
+	buf := bytes.NewBuffer(append(util.GetBytes(), compressFlate))
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(buf)
+	w.Write(bs)
+	w.Close()
+	flateWriters.Put(w)
+	out := buf.Bytes()
+	if len(out) > len(bs) {
+		// Not worth it, so send it uncompressed
+		out = append(append(out[:0], compressNone), bs...)
+	}
+	util.PutBytes(bs)
+	return out
+}
+
+// Removes the marker from the front of a received packet, and decompresses the
+// rest if needed. Returns false if the packet isn't valid, in which case it has
+// already been freed. The original packet is either returned or freed.
+func decompressPacket(bs []byte) ([]byte, bool) {
+	switch {
+	case len(bs) >= 1 && bs[0] == compressNone:
+		copy(bs, bs[1:])
+		return bs[:len(bs)-1], true
+	case len(bs) >= 1 && bs[0] == compressFlate:
+		r := flateReaders.Get().(io.ReadCloser)
+		r.(flate.Resetter).Reset(bytes.NewReader(bs[1:]), nil)
+		out := bytes.NewBuffer(util.GetBytes())
+		_, err := io.Copy(out, io.LimitReader(r, maxDecompressedLen+1))
+		flateReaders.Put(r)
+		util.PutBytes(bs)
+		if err != nil || out.Len() > maxDecompressedLen {
+			util.PutBytes(out.Bytes())
+			return nil, false
+		}
+		return out.Bytes(), true
+	default:
+		util.PutBytes(bs)
+		return nil, false
+	}
+}
+
+// A received packet, as it goes through the recv worker.
+type sessionRecvPacket struct {
+	packet         wire_trafficPacket
+	key            crypto.BoxSharedKey // the current shared key, when the nonce was checked
+	prevKey        crypto.BoxSharedKey // the previous shared key, if tryPrev
+	tryCurrent     bool                // the nonce is OK for the current key
+	tryPrev        bool                // the nonce is OK for the previous key
+	bs             []byte              // the decrypted (and decompressed) packet
+	isOK           bool                // decrypted (and decompressed) successfully
+	isStale        bool                // decrypted with the previous key
+	badCompression bool                // decrypted, but couldn't be decompressed
+	hasMarker      bool                // packets under key have a compression marker
+	prevHasMarker  bool                // packets under prevKey have a compression marker
+	hasTrace       bool                // packets under key have a trace header
+	prevHasTrace   bool                // packets under prevKey have a trace header
+	traceID        uint64              // from the trace header, if there was one
+	badTrace       bool                // decrypted, but the trace header wasn't valid
+	isAccepted     bool                // passed the checks after decrypting, so can be passed to the Conn
+}
+
+// Checks a decrypted packet against the session, which may have been updated
+// while the packet was being decrypted, and updates the nonces and counters if
+// it's accepted. Returns false (and counts the drop) if the packet should be
+// dropped instead. The caller must hold the session mutex.
+func (sinfo *sessionInfo) acceptPacket(r *sessionRecvPacket) bool {
+	if !r.isOK {
+		switch {
+		case r.badCompression:
+			sinfo.drops[dropBadCompression]++
+		case r.badTrace:
+			sinfo.drops[dropBadTraceHeader]++
+		default:
+			sinfo.drops[dropDecryptFailed]++
+		}
+		return false
+	}
+	if !r.isStale && r.key != sinfo.sharedSesKey && sinfo.hasPrevSesKey && r.key == sinfo.prevSesKey {
+		// The keys were rotated while decrypting, so this is now a late packet
+		// under the previous key, not a bad one
+		r.isStale, r.prevKey = true, r.key
+	}
+	if r.isStale {
+		switch {
+		case !sinfo.hasPrevSesKey || r.prevKey != sinfo.prevSesKey || !sinfo.prevNonceIsOK(&r.packet.Nonce):
+			// The session updated in the mean time
+			sinfo.drops[dropSessionUpdated]++
+			return false
+		case sinfo.core.sessions.now().After(sinfo.prevKeyExpires):
+			// Sent under the old key, but the grace window ended while decrypting
+			sinfo.drops[dropStaleKey]++
+			return false
+		}
+		sinfo.updatePrevNonce(&r.packet.Nonce)
+		sinfo.staleKeyRecvd++
+		sinfo.time = sinfo.core.sessions.now()
+		sinfo.packetsRecvd++
+		return true
+	}
+	if r.key != sinfo.sharedSesKey || !sinfo.nonceIsOK(&r.packet.Nonce) {
+		// The session updated in the mean time
+		sinfo.drops[dropSessionUpdated]++
+		return false
+	}
+	sinfo.updateNonce(&r.packet.Nonce)
+	sinfo.time = sinfo.core.sessions.now()
+	sinfo.packetsRecvd++
+	return true
+}
+
 func (sinfo *sessionInfo) recvWorker() {
 	// TODO move theirNonce etc into a struct that gets stored here, passed in over a channel
 	//  Since there's no reason for anywhere else in the session code to need to *read* it...
 	//  Only needs to be updated from the outside if a ping resets it...
 	//  That would get rid of the need to take a mutex for the sessionFunc
 	var callbacks []chan func()
-	doRecv := func(p wire_trafficPacket) {
-		var bs []byte
-		var err error
-		var k crypto.BoxSharedKey
-		sessionFunc := func() {
-			if !sinfo.nonceIsOK(&p.Nonce) {
-				err = ConnError{errors.New("packet dropped due to invalid nonce"), false, true, false, 0}
-				return
+	defer func() { sinfo.core.sessions.addCallbacks(-len(callbacks)) }()
+	var limiter sessionRateLimiter
+	doRecv := func(ps []wire_trafficPacket) {
+		// Check the nonces of the whole batch, and get the keys to try, under a
+		// single lock, rather than taking the mutex for every packet
+		batch := make([]sessionRecvPacket, 0, len(ps))
+		sinfo.doFunc(func() {
+			now := sinfo.core.sessions.now()
+			if sinfo.hasPrevSesKey {
+				sinfo.expirePrevKey()
 			}
-			k = sinfo.sharedSesKey
-		}
-		sinfo.doFunc(sessionFunc)
-		if err != nil {
-			util.PutBytes(p.Payload)
+			for _, p := range ps {
+				sinfo.recvPktRate.add(now)
+				if limit := sinfo.recvPktLimit; limit > 0 && !limiter.allow(now, 1, limit, limit) {
+					// Drop before decrypting, since that's most of the cost of a packet
+					sinfo.drops[dropRateLimited]++
+					util.PutBytes(p.Payload)
+					continue
+				}
+				r := sessionRecvPacket{
+					packet:    p,
+					key:       sinfo.sharedSesKey,
+					hasMarker: sinfo.usesCompression(),
+					hasTrace:  sinfo.theirTraceIDs,
+				}
+				r.tryCurrent = sinfo.nonceIsOK(&p.Nonce)
+				if sinfo.hasPrevSesKey {
+					// The packet may have been sent before the remote end rotated keys
+					r.tryPrev = sinfo.prevNonceIsOK(&p.Nonce)
+					r.prevKey = sinfo.prevSesKey
+					r.prevHasMarker = sinfo.prevCompress
+					r.prevHasTrace = sinfo.prevTraceIDs
+				}
+				if !r.tryCurrent && !r.tryPrev {
+					sinfo.drops[dropInvalidNonce]++
+					util.PutBytes(p.Payload)
+					continue
+				}
+				batch = append(batch, r)
+			}
+		})
+		if len(batch) == 0 {
 			return
 		}
-		var isOK bool
 		ch := make(chan func(), 1)
 		poolFunc := func() {
-			bs, isOK = crypto.BoxOpen(&k, p.Payload, &p.Nonce)
-			callback := func() {
-				util.PutBytes(p.Payload)
-				if !isOK {
-					util.PutBytes(bs)
-					return
+			for idx := range batch {
+				r := &batch[idx]
+				if r.tryCurrent {
+					r.bs, r.isOK = crypto.BoxOpen(&r.key, r.packet.Payload, &r.packet.Nonce)
 				}
-				sessionFunc = func() {
-					if k != sinfo.sharedSesKey || !sinfo.nonceIsOK(&p.Nonce) {
-						// The session updated in the mean time, so return an error
-						err = ConnError{errors.New("session updated during crypto operation"), false, true, false, 0}
-						return
-					}
-					sinfo.updateNonce(&p.Nonce)
-					sinfo.time = time.Now()
-					sinfo.bytesRecvd += uint64(len(bs))
+				if !r.isOK && r.tryPrev {
+					util.PutBytes(r.bs)
+					r.bs, r.isOK = crypto.BoxOpen(&r.prevKey, r.packet.Payload, &r.packet.Nonce)
+					r.isStale = r.isOK
 				}
-				sinfo.doFunc(sessionFunc)
-				if err != nil {
-					// Not sure what else to do with this packet, I guess just drop it
-					util.PutBytes(bs)
-				} else {
+				util.PutBytes(r.packet.Payload)
+				if r.isOK && (r.isStale && r.prevHasMarker || !r.isStale && r.hasMarker) {
+					r.bs, r.isOK = decompressPacket(r.bs)
+					r.badCompression = !r.isOK
+				}
+				if r.isOK && (r.isStale && r.prevHasTrace || !r.isStale && r.hasTrace) {
+					r.bs, r.traceID, r.isOK = takeTraceHeader(r.bs)
+					r.badTrace = !r.isOK
+				}
+			}
+			callback := func() {
+				// Apply the nonce and counter updates for the whole batch under a
+				// single lock too, checking each packet in turn, since the session
+				// may have been updated while the batch was being decrypted
+				sinfo.doFunc(func() {
+					for idx := range batch {
+						batch[idx].isAccepted = sinfo.acceptPacket(&batch[idx])
+					}
+				})
+				for idx := range batch {
+					r := &batch[idx]
+					switch {
+					case r.isAccepted:
+					case r.badCompression:
+						// Already freed by decompressPacket
+						continue
+					default:
+						// Not sure what else to do with this packet, I guess just drop it
+						util.PutBytes(r.bs)
+						continue
+					}
+					atomic.AddUint64(&sinfo.bytesRecvd, uint64(len(r.bs)))
+					msg := recvMessage{message: r.bs, traceID: r.traceID}
 					// Pass the packet to the buffer for Conn.Read
 					select {
 					case <-sinfo.cancel.Finished():
-						util.PutBytes(bs)
-					case sinfo.recv <- bs:
+						util.PutBytes(r.bs)
+					case sinfo.recv <- msg:
 					}
 				}
 			}
 			ch <- callback
 		}
 		// Send to the worker and wait for it to finish
-		util.WorkerGo(poolFunc)
+		// If the pool can't take it right now, do the work here instead of blocking
+		if !util.TryWorkerGo(poolFunc) {
+			poolFunc()
+		}
 		callbacks = append(callbacks, ch)
+		sinfo.core.sessions.addCallbacks(1)
 	}
-	fromHelper := make(chan wire_trafficPacket, 1)
+	fromHelper := make(chan []wire_trafficPacket, 1)
 	go func() {
 		var buf []wire_trafficPacket
+		var maxBuf int
+		sinfo.doFunc(func() { maxBuf = sinfo.nonceHeapSize })
 		for {
 			for len(buf) > 0 {
+				// Hand over as much as possible at once, so it can be done as a batch
+				batch := buf
+				if len(batch) > maxRecvBatch {
+					batch = batch[:maxRecvBatch]
+				}
 				select {
 				case <-sinfo.cancel.Finished():
 					return
 				case p := <-sinfo.fromRouter:
 					buf = append(buf, p)
-					for len(buf) > 64 { // Based on nonce window size
+					if len(buf) > maxBuf {
+						// Based on nonce heap size, check it's not been reconfigured since
+						sinfo.doFunc(func() { maxBuf = sinfo.nonceHeapSize })
+					}
+					for len(buf) > maxBuf {
 						util.PutBytes(buf[0].Payload)
 						buf = buf[1:]
+						sinfo.doFunc(func() {
+							sinfo.drops[dropBufferFull]++
+						})
 					}
-				case fromHelper <- buf[0]:
-					buf = buf[1:]
+				case fromHelper <- batch:
+					buf = buf[len(batch):]
 				}
 			}
 			select {
@@ -576,69 +2278,364 @@ func (sinfo *sessionInfo) recvWorker() {
 	}
 	for {
 		for len(callbacks) > 0 {
+			if sinfo.core.sessions.isUnderPressure(len(callbacks)) {
+				// Don't take any more packets until some of ours are done
+				select {
+				case f := <-callbacks[0]:
+					callbacks = callbacks[1:]
+					sinfo.core.sessions.addCallbacks(-1)
+					f()
+				case <-sinfo.cancel.Finished():
+					return
+				}
+				continue
+			}
 			select {
 			case f := <-callbacks[0]:
 				callbacks = callbacks[1:]
+				sinfo.core.sessions.addCallbacks(-1)
 				f()
 			case <-sinfo.cancel.Finished():
 				return
-			case p := <-fromHelper:
-				doRecv(p)
+			case ps := <-fromHelper:
+				doRecv(ps)
 			}
 		}
 		select {
 		case <-sinfo.cancel.Finished():
 			return
-		case p := <-fromHelper:
-			doRecv(p)
+		case ps := <-fromHelper:
+			doRecv(ps)
 		}
 	}
 }
 
+// Sets the send priority of a flow, or puts it back to the default of 0.
+func (ss *sessions) setFlowPriority(flowKey uint64, priority int) {
+	ss.flowPriorityLock.Lock()
+	defer ss.flowPriorityLock.Unlock()
+	if priority == 0 {
+		delete(ss.flowPriorities, flowKey)
+	} else {
+		ss.flowPriorities[flowKey] = priority
+	}
+}
+
+// Gets the send priority of a flow, and whether any flows have priorities set
+// at all. Safe to call from any goroutine.
+func (ss *sessions) getFlowPriority(flowKey uint64) (priority int, isSet bool) {
+	ss.flowPriorityLock.RLock()
+	defer ss.flowPriorityLock.RUnlock()
+	return ss.flowPriorities[flowKey], len(ss.flowPriorities) > 0
+}
+
+// Packets waiting to be sent by a session's send worker, queued by the priority
+// of their flow, so that packets from more important flows can go first.
+type sessionSendQueue struct {
+	queues  [numFlowPriorities][]FlowKeyMessage
+	skipped [numFlowPriorities]int // packets sent from other queues while this one was waiting
+	flows   map[uint64]*queuedFlow // flows with packets in the queues
+	size    int                    // total number of packets in the queues
+}
+
+// Which queue a flow's packets are in, and how many there are.
+type queuedFlow struct {
+	priority int
+	count    int
+}
+
+// Adds a packet to the queue for the given priority. If the flow already has
+// packets queued then it's added after them instead, even if the priority of
+// the flow has changed, so that the packets in a flow are never reordered.
+func (q *sessionSendQueue) push(msg FlowKeyMessage, priority int) {
+	if q.flows == nil {
+		q.flows = make(map[uint64]*queuedFlow)
+	}
+	flow, isIn := q.flows[msg.FlowKey]
+	if !isIn {
+		flow = &queuedFlow{priority: priority}
+		q.flows[msg.FlowKey] = flow
+	}
+	flow.count++
+	q.queues[flow.priority] = append(q.queues[flow.priority], msg)
+	q.size++
+}
+
+// Removes the next packet to send, which is usually the first packet from the
+// highest priority queue. Lower priority queues are skipped over at most
+// maxPrioritySkips times in a row, so they're slowed down but never starved.
+// The queue must not be empty.
+func (q *sessionSendQueue) pop() FlowKeyMessage {
+	next := -1
+	for p := numFlowPriorities - 1; p >= 0; p-- {
+		switch {
+		case len(q.queues[p]) == 0:
+		case next < 0:
+			next = p
+		case q.skipped[p] >= maxPrioritySkips && q.skipped[p] > q.skipped[next]:
+			next = p
+		}
+	}
+	for p := range q.queues {
+		if p != next && len(q.queues[p]) > 0 {
+			q.skipped[p]++
+		}
+	}
+	q.skipped[next] = 0
+	msg := q.queues[next][0]
+	q.queues[next] = q.queues[next][1:]
+	q.size--
+	if flow := q.flows[msg.FlowKey]; flow.count == 1 {
+		delete(q.flows, msg.FlowKey)
+	} else {
+		flow.count--
+	}
+	return msg
+}
+
+// A token bucket, used by the send worker to limit a session's send rate.
+type sessionRateLimiter struct {
+	rate   uint64    // bytes per second
+	burst  uint64    // the most tokens the bucket can hold
+	tokens float64   // bytes that can be sent right now, negative if we're over
+	last   time.Time // when tokens was last topped up
+}
+
+// Takes tokens for a packet of the given size, and returns how long to wait
+// before sending it to stay within the rate. Packets bigger than the bucket
+// are allowed, they just mean a longer wait afterwards. A burst of 0 means
+// that the bucket holds one second's worth of tokens.
+func (l *sessionRateLimiter) take(now time.Time, size int, rate uint64, burst uint64) time.Duration {
+	l.refill(now, rate, burst)
+	l.tokens -= float64(size)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+}
+
+// Like take, but for traffic which is dropped rather than delayed when it's
+// over the rate. Returns false, without taking any tokens, if there aren't
+// enough in the bucket right now.
+func (l *sessionRateLimiter) allow(now time.Time, size int, rate uint64, burst uint64) bool {
+	l.refill(now, rate, burst)
+	if l.tokens < float64(size) {
+		return false
+	}
+	l.tokens -= float64(size)
+	return true
+}
+
+// Tops up the bucket with the tokens earned since it was last used.
+func (l *sessionRateLimiter) refill(now time.Time, rate uint64, burst uint64) {
+	if burst == 0 {
+		burst = rate
+	}
+	if rate != l.rate || burst != l.burst {
+		// Start again with a full bucket if the limit is changed
+		l.rate, l.burst = rate, burst
+		l.tokens = float64(burst)
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+		if l.tokens > float64(burst) {
+			l.tokens = float64(burst)
+		}
+	}
+	l.last = now
+}
+
+// Measures the rate of packets over intervals of about a second.
+type sessionPacketRate struct {
+	start time.Time // when the current interval started
+	count uint64    // packets counted so far in the current interval
+	rate  float64   // packets per second over the previous interval
+}
+
+// Counts a packet.
+func (r *sessionPacketRate) add(now time.Time) {
+	if elapsed := now.Sub(r.start); elapsed >= time.Second {
+		r.rate = float64(r.count) / elapsed.Seconds()
+		r.start, r.count = now, 0
+	}
+	r.count++
+}
+
+// Returns the most recent packets per second measurement.
+func (r *sessionPacketRate) get(now time.Time) float64 {
+	if elapsed := now.Sub(r.start); elapsed >= time.Second {
+		// The current interval is over, even if no packet has ended it yet
+		return float64(r.count) / elapsed.Seconds()
+	}
+	return r.rate
+}
+
 func (sinfo *sessionInfo) sendWorker() {
 	// TODO move info that this worker needs here, send updates via a channel
 	//  Otherwise we need to take a mutex to avoid races with update()
 	var callbacks []chan func()
-	doSend := func(msg FlowKeyMessage) {
-		var p wire_trafficPacket
+	defer func() { sinfo.core.sessions.addCallbacks(-len(callbacks)) }()
+	// Sends everything that has already been encrypted, returns false if the
+	// session was canceled in the mean time
+	flush := func() bool {
+		for _, ch := range callbacks {
+			select {
+			case f := <-ch:
+				f()
+			case <-sinfo.cancel.Finished():
+				return false
+			}
+		}
+		sinfo.core.sessions.addCallbacks(-len(callbacks))
+		callbacks = nil
+		return true
+	}
+	var limiter sessionRateLimiter
+	doSend := func(msgs []FlowKeyMessage) {
+		ps := make([]wire_trafficPacket, len(msgs))
 		var k crypto.BoxSharedKey
+		var hasTrace, hasMarker bool
+		var rateLimit, rateBurst uint64
+		var size int
 		sessionFunc := func() {
-			sinfo.bytesSent += uint64(len(msg.Message))
-			p = wire_trafficPacket{
-				Coords: append([]byte(nil), sinfo.coords...),
-				Handle: sinfo.theirHandle,
-				Nonce:  sinfo.myNonce,
-			}
-			if msg.FlowKey != 0 {
-				// Helps ensure that traffic from this flow ends up in a separate queue from other flows
-				// The zero padding relies on the fact that the self-peer is always on port 0
-				p.Coords = append(p.Coords, 0)
-				p.Coords = wire_put_uint64(msg.FlowKey, p.Coords)
-			}
-			sinfo.myNonce.Increment()
+			hasTrace = sinfo.myTraceIDs
+			hasMarker = sinfo.usesCompression()
+			rateLimit, rateBurst = sinfo.sendRateLimit, sinfo.sendRateBurst
+			for idx, msg := range msgs {
+				size += len(msg.Message)
+				p := wire_trafficPacket{
+					Coords: append([]byte(nil), sinfo.coords...),
+					Handle: sinfo.theirHandle,
+					Nonce:  sinfo.myNonce,
+				}
+				if msg.FlowKey != 0 {
+					// Helps ensure that traffic from this flow ends up in a separate queue from other flows
+					// The zero padding relies on the fact that the self-peer is always on port 0
+					p.Coords = append(p.Coords, 0)
+					p.Coords = wire_put_uint64(msg.FlowKey, p.Coords)
+				}
+				ps[idx] = p
+				sinfo.myNonce.Increment()
+			}
+			sinfo.packetsSent += uint64(len(msgs))
+			sinfo.keyBytesSent += uint64(size)
+			switch {
+			case sinfo.myNonce.NearMax():
+				// Rotating keys resets the nonce, so it never wraps around
+				sinfo.requestRotate()
+			case sinfo.keyRotateBytes > 0 && sinfo.keyBytesSent >= sinfo.keyRotateBytes:
+				// Too much traffic has been sent under the same keys, but if we
+				// only just rotated, then wait for a later packet to do it
+				if sinfo.core.sessions.now().Sub(sinfo.keyTime) >= minKeyRotationInterval {
+					sinfo.requestRotate()
+				}
+			}
 			k = sinfo.sharedSesKey
 		}
-		// Get the mutex-protected info needed to encrypt the packet
+		// Get the mutex-protected info needed to encrypt the whole batch, under a
+		// single lock, rather than taking the mutex for every packet
 		sinfo.doFunc(sessionFunc)
+		atomic.AddUint64(&sinfo.bytesSent, uint64(size))
+		if rateLimit > 0 {
+			if wait := limiter.take(sinfo.core.sessions.now(), size, rateLimit, rateBurst); wait > 0 {
+				// Over the limit, so hold these packets back (without dropping them)
+				// until enough time has passed, after sending anything queued
+				if !flush() {
+					for _, msg := range msgs {
+						util.PutBytes(msg.Message)
+					}
+					return
+				}
+				timer := time.NewTimer(wait)
+				select {
+				case <-sinfo.cancel.Finished():
+					util.TimerStop(timer)
+					for _, msg := range msgs {
+						util.PutBytes(msg.Message)
+					}
+					return
+				case <-timer.C:
+				}
+			}
+		}
+		if hasTrace {
+			for idx := range msgs {
+				msgs[idx].Message = putTraceHeader(msgs[idx])
+			}
+		}
 		ch := make(chan func(), 1)
 		poolFunc := func() {
-			// Encrypt the packet
-			p.Payload, _ = crypto.BoxSeal(&k, msg.Message, &p.Nonce)
-			// The callback will send the packet
+			for idx := range msgs {
+				if hasMarker {
+					msgs[idx].Message = compressPacket(msgs[idx].Message)
+				}
+				// Encrypt the packet
+				ps[idx].Payload, _ = crypto.BoxSeal(&k, msgs[idx].Message, &ps[idx].Nonce)
+			}
+			// The callback will send the packets
 			callback := func() {
-				// Encoding may block on a util.GetBytes(), so kept out of the worker pool
-				packet := p.encode()
-				// Cleanup
-				util.PutBytes(msg.Message)
-				util.PutBytes(p.Payload)
-				// Send the packet
-				sinfo.core.router.out(packet)
+				for idx := range msgs {
+					// Encoding may block on a util.GetBytes(), so kept out of the worker pool
+					packet := ps[idx].encode()
+					// Cleanup
+					util.PutBytes(msgs[idx].Message)
+					util.PutBytes(ps[idx].Payload)
+					// Send the packet
+					sinfo.core.router.out(packet)
+				}
 			}
 			ch <- callback
 		}
 		// Send to the worker and wait for it to finish
-		util.WorkerGo(poolFunc)
+		// If the pool can't take it right now, do the work here instead of blocking
+		if !util.TryWorkerGo(poolFunc) {
+			poolFunc()
+		}
 		callbacks = append(callbacks, ch)
+		sinfo.core.sessions.addCallbacks(1)
+	}
+	var queue sessionSendQueue
+	// Moves anything waiting to be sent into the queue, without blocking, so
+	// that it can be sent ahead of less important packets that are already
+	// queued
+	drain := func() {
+		for queue.size < cap(sinfo.send) {
+			select {
+			case msg := <-sinfo.send:
+				priority, _ := sinfo.core.sessions.getFlowPriority(msg.FlowKey)
+				queue.push(msg, priority)
+			default:
+				return
+			}
+		}
+	}
+	// Queues a packet by the priority of its flow, along with any others that
+	// are already waiting, so that the most important can be sent first. If no
+	// flows have priorities set then there's nothing to reorder, so the packet is
+	// sent straight away.
+	schedule := func(msg FlowKeyMessage) {
+		priority, isSet := sinfo.core.sessions.getFlowPriority(msg.FlowKey)
+		if !isSet && queue.size == 0 {
+			// Take anything else that's already waiting too, so that the whole
+			// batch can be sent under a single lock. Nothing else reads from the
+			// channel, so this never blocks
+			msgs := []FlowKeyMessage{msg}
+			for len(msgs) < maxSendBatch && len(sinfo.send) > 0 {
+				msgs = append(msgs, <-sinfo.send)
+			}
+			doSend(msgs)
+			return
+		}
+		queue.push(msg, priority)
+		drain()
+	}
+	// Sends everything that has already been encrypted, and then rotates keys, so
+	// that the remote end gets those packets before it sees the new key
+	doRotate := func() bool {
+		if !flush() {
+			return false
+		}
+		sinfo.doFunc(sinfo.rotateKeys)
+		return true
 	}
 	select {
 	case <-sinfo.cancel.Finished():
@@ -647,22 +2644,66 @@ func (sinfo *sessionInfo) sendWorker() {
 		// Wait until the session has finished initializing before processing any packets
 	}
 	for {
-		for len(callbacks) > 0 {
+		for len(callbacks) > 0 || queue.size > 0 {
+			if sinfo.core.sessions.isUnderPressure(len(callbacks)) {
+				// Don't take any more packets until some of ours are done
+				select {
+				case f := <-callbacks[0]:
+					callbacks = callbacks[1:]
+					sinfo.core.sessions.addCallbacks(-1)
+					f()
+				case <-sinfo.cancel.Finished():
+					return
+				}
+				continue
+			}
+			var next chan func()
+			if len(callbacks) > 0 {
+				next = callbacks[0]
+			}
+			if queue.size > 0 {
+				// Keep sending what's queued, once anything that's ready is out
+				select {
+				case f := <-next:
+					callbacks = callbacks[1:]
+					sinfo.core.sessions.addCallbacks(-1)
+					f()
+				case <-sinfo.cancel.Finished():
+					return
+				case <-sinfo.rotate:
+					if !doRotate() {
+						return
+					}
+				default:
+					drain()
+					doSend([]FlowKeyMessage{queue.pop()})
+				}
+				continue
+			}
 			select {
-			case f := <-callbacks[0]:
+			case f := <-next:
 				callbacks = callbacks[1:]
+				sinfo.core.sessions.addCallbacks(-1)
 				f()
 			case <-sinfo.cancel.Finished():
 				return
 			case msg := <-sinfo.send:
-				doSend(msg)
+				schedule(msg)
+			case <-sinfo.rotate:
+				if !doRotate() {
+					return
+				}
 			}
 		}
 		select {
 		case <-sinfo.cancel.Finished():
 			return
 		case bs := <-sinfo.send:
-			doSend(bs)
+			schedule(bs)
+		case <-sinfo.rotate:
+			if !doRotate() {
+				return
+			}
 		}
 	}
 }
@@ -0,0 +1,2025 @@
+package yggdrasil
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gologme/log"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+	"github.com/yggdrasil-network/yggdrasil-go/src/crypto"
+	"github.com/yggdrasil-network/yggdrasil-go/src/util"
+)
+
+// Starts a node with a newly generated config, which configure can change
+// first if it isn't nil. The node has no peers until peerTestCores is used.
+func newTestCore(t testing.TB, configure func(*config.NodeConfig)) *Core {
+	cfg := config.GenerateConfig()
+	cfg.AdminListen = "none"
+	if configure != nil {
+		configure(cfg)
+	}
+	core := new(Core)
+	if _, err := core.Start(cfg, log.New(ioutil.Discard, "", 0)); err != nil {
+		t.Fatal(err)
+	}
+	return core
+}
+
+// Peers two nodes with each other over a loopback TCP connection.
+func peerTestCores(t testing.TB, a, b *Core) {
+	listener, err := a.ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.CallPeer("tcp://"+listener.Listener.Addr().String(), ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Dials a session from one node to another, retrying until the DHT has had a
+// chance to converge.
+func dialTestCore(t testing.TB, from, to *Core) *Conn {
+	dialer, err := from.ConnDialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := dialer.Dial("nodeid", hex.EncodeToString(to.NodeID()[:]))
+		switch {
+		case err == nil:
+			return conn
+		case time.Now().After(deadline):
+			t.Fatal("failed to dial test node:", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Waits for the next incoming session on a listener.
+func acceptTestConn(t testing.TB, listener *Listener) *Conn {
+	accepted := make(chan *Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		return conn
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for an incoming session")
+	}
+	return nil
+}
+
+// Writes a packet to one Conn and checks that it's read from the other.
+func checkTestTraffic(t testing.TB, from, to *Conn, msg string) {
+	if _, err := from.Write([]byte(msg)); err != nil {
+		t.Fatal("write failed:", err)
+	}
+	to.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 65535)
+	n, err := to.Read(buf)
+	if err != nil {
+		t.Fatal("read failed:", err)
+	}
+	if got := string(buf[:n]); got != msg {
+		t.Fatalf("read %q, expected %q", got, msg)
+	}
+}
+
+func TestFreezeSessions(t *testing.T) {
+	a, b, c := newTestCore(t, nil), newTestCore(t, nil), newTestCore(t, nil)
+	defer a.Stop()
+	defer b.Stop()
+	defer c.Stop()
+	peerTestCores(t, a, b)
+	peerTestCores(t, c, b)
+	listener, err := a.ConnListen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outgoing := dialTestCore(t, b, a)
+	incoming := acceptTestConn(t, listener)
+	checkTestTraffic(t, outgoing, incoming, "before freezing")
+
+	b.SetSessionsFrozen(true)
+	dialer, _ := b.ConnDialer()
+	// The search for the other node can fail until the DHT converges, so keep
+	// trying until the session itself has been refused
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		if _, err := dialer.Dial("nodeid", hex.EncodeToString(c.NodeID()[:])); err == nil {
+			t.Fatal("opened a new session while frozen")
+		}
+		if frozen, refused := b.GetSessionsFrozen(); !frozen {
+			t.Fatal("sessions aren't frozen")
+		} else if refused > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no sessions were refused while frozen")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	// The existing session carries on in both directions
+	checkTestTraffic(t, outgoing, incoming, "while frozen")
+	checkTestTraffic(t, incoming, outgoing, "reply while frozen")
+
+	b.SetSessionsFrozen(false)
+	if _, err := c.ConnListen(); err != nil {
+		t.Fatal(err)
+	}
+	dialTestCore(t, b, c)
+}
+
+// Dials a node that never answers the handshake, retrying while the search
+// fails, and returns the error once a session was actually attempted.
+func dialUnresponsiveTestCore(t testing.TB, from, to *Core) error {
+	dialer, err := from.ConnDialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		_, err := dialer.Dial("nodeid", hex.EncodeToString(to.NodeID()[:]))
+		switch {
+		case err == nil:
+			t.Fatal("opened a session to an unresponsive node")
+		case err.Error() == "session handshake timeout":
+			return err
+		case time.Now().After(deadline):
+			t.Fatal("no session was attempted:", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	a := newTestCore(t, nil)
+	b := newTestCore(t, func(cfg *config.NodeConfig) {
+		cfg.SessionOptions.HandshakeTimeout = 1
+	})
+	defer a.Stop()
+	defer b.Stop()
+	peerTestCores(t, a, b)
+	// Without a listener, a never answers the session pings
+	start := time.Now()
+	err := dialUnresponsiveTestCore(t, b, a)
+	if e, ok := err.(ConnError); !ok || !e.Timeout() {
+		t.Fatalf("expected a timeout ConnError, got %#v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= defaultHandshakeTimeout {
+		t.Fatal("the configured handshake timeout wasn't used, took", elapsed)
+	}
+}
+
+func TestHandshakeRetry(t *testing.T) {
+	a, b := newTestCore(t, nil), newTestCore(t, nil)
+	defer a.Stop()
+	defer b.Stop()
+	peerTestCores(t, a, b)
+	// The first ping is ignored because a isn't listening yet, so the session
+	// only opens if one of the retries gets through before the deadline
+	first := make(chan *sessionInfo, 1)
+	go func() {
+		for {
+			var sinfo *sessionInfo
+			b.router.doAdmin(func() {
+				sinfo, _ = b.sessions.getByTheirPerm(&a.boxPub)
+			})
+			if sinfo != nil {
+				a.ConnListen()
+				first <- sinfo
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	conn := dialTestCore(t, b, a)
+	defer conn.Close()
+	if sinfo := <-first; conn.session != sinfo {
+		t.Fatal("the first session didn't complete its handshake")
+	}
+}
+
+func TestGetUnresponsive(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	tests := []struct {
+		name         string
+		lastRecvd    time.Duration // Before now
+		firstPing    time.Duration // Before now
+		unresponsive bool
+	}{
+		{"recently received", time.Second, 2 * time.Second, false},
+		{"idle without pinging", time.Minute, 2 * time.Minute, false},
+		{"pinging recently", time.Minute, time.Second, true},
+		{"pinged once long ago", time.Minute, 50 * time.Second, true},
+		{"pinging within threshold", 5 * time.Second, 4 * time.Second, false},
+		{"never answered", time.Minute, time.Minute, true},
+	}
+	for _, test := range tests {
+		ss := sessions{
+			sinfos: make(map[crypto.Handle]*sessionInfo),
+			now:    func() time.Time { return now },
+		}
+		ss.sinfos[crypto.Handle{}] = &sessionInfo{
+			time:     now.Add(-test.lastRecvd),
+			pingTime: now.Add(-test.firstPing),
+		}
+		if got := len(ss.getUnresponsive(10*time.Second)) == 1; got != test.unresponsive {
+			t.Errorf("%s: got unresponsive=%v, expected %v", test.name, got, test.unresponsive)
+		}
+	}
+}
+
+func TestHandlePrefix(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		expected []byte // Start of every generated handle
+		invalid  bool
+	}{
+		{"", nil, false},
+		{"be", []byte{0xbe}, false},
+		{"beef", []byte{0xbe, 0xef}, false},
+		{"0102030405", []byte{1, 2, 3, 4}, false}, // Truncated to MaxHandlePrefixLen
+		{"xyz", nil, true},
+	}
+	for _, test := range tests {
+		prefix, err := getHandlePrefix(&config.SessionOptions{HandlePrefix: test.prefix})
+		if (err != nil) != test.invalid {
+			t.Errorf("%q: got error %v, expected invalid=%v", test.prefix, err, test.invalid)
+			continue
+		}
+		for i := 0; i < 16; i++ {
+			handle := crypto.NewHandleWithPrefix(prefix)
+			if !bytes.HasPrefix(handle[:], test.expected) {
+				t.Errorf("%q: generated handle %x", test.prefix, handle[:])
+				break
+			}
+		}
+	}
+	// The prefix is decoded once when the config is loaded, not per session
+	core := newTestCore(t, func(cfg *config.NodeConfig) {
+		cfg.SessionOptions.HandlePrefix = "beef"
+	})
+	defer core.Stop()
+	var prefix []byte
+	core.router.doAdmin(func() {
+		prefix = core.sessions.handlePrefix
+	})
+	if !bytes.Equal(prefix, []byte{0xbe, 0xef}) {
+		t.Fatalf("loaded handle prefix %x", prefix)
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      uint64
+		expected  int
+		isClamped bool
+	}{
+		{"unset", 0, defaultSessionBufferSize, false},
+		{"smallest", 1, 1, false},
+		{"configured", 256, 256, false},
+		{"largest", maxSessionBufferSize, maxSessionBufferSize, false},
+		{"too large", maxSessionBufferSize + 1, maxSessionBufferSize, true},
+		{"overflows int", 1 << 63, maxSessionBufferSize, true},
+	}
+	for _, test := range tests {
+		if size, isClamped := getBufferSize(test.size); size != test.expected || isClamped != test.isClamped {
+			t.Errorf("%s: got %d (clamped=%v), expected %d (clamped=%v)", test.name, size, isClamped, test.expected, test.isClamped)
+		}
+	}
+}
+
+func TestWorkerPoolSaturated(t *testing.T) {
+	a, b := newTestCore(t, nil), newTestCore(t, nil)
+	defer a.Stop()
+	defer b.Stop()
+	peerTestCores(t, a, b)
+	listener, err := a.ConnListen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outgoing := dialTestCore(t, b, a)
+	incoming := acceptTestConn(t, listener)
+	// Tie up every worker, and fill the queue behind them, until the pool
+	// refuses any more jobs
+	release := make(chan struct{})
+	defer close(release)
+	for util.TryWorkerGo(func() { <-release }) {
+	}
+	// Sessions do their crypto inline rather than waiting for the pool
+	for i := 0; i < 8; i++ {
+		checkTestTraffic(t, outgoing, incoming, "while saturated")
+		checkTestTraffic(t, incoming, outgoing, "reply while saturated")
+	}
+}
+
+// Makes a session that isn't connected to anything, for testing the parts of
+// the session code that don't touch the network. It reads the time from clock.
+func newTestSessionInfo(clock *time.Time) *sessionInfo {
+	core := new(Core)
+	core.log = log.New(ioutil.Discard, "", 0)
+	core.sessions.now = func() time.Time { return *clock }
+	return &sessionInfo{
+		core:          core,
+		init:          make(chan struct{}),
+		nonceWindow:   defaultNonceWindow,
+		nonceHeapSize: defaultNonceHeapSize,
+		theirNonceMap: make(map[crypto.BoxNonce]time.Time),
+		features:      make(map[string]bool),
+	}
+}
+
+// Makes a nonce that counts up with n, like the ones a session sends.
+func testNonce(n uint64) *crypto.BoxNonce {
+	var nonce crypto.BoxNonce
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], n)
+	return &nonce
+}
+
+func TestStrictOrderingFeature(t *testing.T) {
+	tests := []struct {
+		nonce  uint64
+		lax    bool // Expected from nonceIsOK without strict ordering
+		strict bool // Expected from nonceIsOK with strict ordering
+	}{
+		{11, true, false}, // Arrived late, but not seen before
+		{12, false, false},
+		{9, false, false}, // Older than anything we're tracking
+		{13, true, true},
+	}
+	for _, strict := range []bool{false, true} {
+		now := time.Unix(1000000, 0)
+		sinfo := newTestSessionInfo(&now)
+		sinfo.features[sessionFeatureStrictOrdering] = strict
+		sinfo.updateNonce(testNonce(10))
+		sinfo.updateNonce(testNonce(12))
+		for _, test := range tests {
+			expected := test.lax
+			if strict {
+				expected = test.strict
+			}
+			if ok := sinfo.nonceIsOK(testNonce(test.nonce)); ok != expected {
+				t.Errorf("strict=%v: nonce %d got ok=%v, expected %v", strict, test.nonce, ok, expected)
+			}
+		}
+	}
+}
+
+func TestEstablishmentRate(t *testing.T) {
+	start := time.Unix(6000000, 0) // On a minute boundary
+	now := start
+	ss := sessions{now: func() time.Time { return now }}
+	tests := []struct {
+		at        time.Duration // Since start
+		succeeded bool
+		expected  [2]uint64 // Succeeded and failed within the window afterwards
+	}{
+		{0, true, [2]uint64{1, 0}},
+		{30 * time.Second, false, [2]uint64{1, 1}},
+		{5 * time.Minute, true, [2]uint64{2, 1}},
+		{9*time.Minute + 59*time.Second, false, [2]uint64{2, 2}},
+		// The first minute has now fallen out of the window
+		{10 * time.Minute, true, [2]uint64{2, 1}},
+		// Reuses the same bucket as the 5 minute mark, which must be reset
+		{15 * time.Minute, false, [2]uint64{1, 2}},
+		{30 * time.Minute, false, [2]uint64{0, 1}},
+	}
+	for _, test := range tests {
+		now = start.Add(test.at)
+		ss.recordEstablishment(test.succeeded)
+		if succeeded, failed := ss.getEstablishments(); succeeded != test.expected[0] || failed != test.expected[1] {
+			t.Errorf("at %v: got %d succeeded and %d failed, expected %v", test.at, succeeded, failed, test.expected)
+		}
+	}
+}
+
+// Waits until a Conn has at least n packets waiting to be read.
+func waitTestQueued(t testing.TB, conn *Conn, n int) {
+	for deadline := time.Now().Add(5 * time.Second); len(conn.session.recv) < n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d packets arrived", len(conn.session.recv), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReadBatch(t *testing.T) {
+	a, b := newTestCore(t, nil), newTestCore(t, nil)
+	defer a.Stop()
+	defer b.Stop()
+	peerTestCores(t, a, b)
+	listener, err := a.ConnListen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outgoing := dialTestCore(t, b, a)
+	incoming := acceptTestConn(t, listener)
+	checkTestTraffic(t, outgoing, incoming, "hello")
+	tests := []struct {
+		name     string
+		sent     []string
+		bufs     []int    // Capacity of each buffer passed to ReadBatch
+		expected []string // Read in each batch, in order
+		err      bool
+	}{
+		{"fewer than bufs", []string{"a", "bb"}, []int{16, 16, 16}, []string{"a", "bb"}, false},
+		{"more than bufs", []string{"c", "d", "e"}, []int{16, 16}, []string{"c", "d"}, false},
+		{"leftover", nil, []int{16, 16}, []string{"e"}, false},
+		{"truncated", []string{"ffffff", "g"}, []int{4, 16}, []string{"ffff"}, true},
+		{"after truncation", nil, []int{16}, []string{"g"}, false},
+	}
+	for _, test := range tests {
+		for _, msg := range test.sent {
+			if _, err := outgoing.Write([]byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		waitTestQueued(t, incoming, len(test.expected))
+		bufs := make([][]byte, len(test.bufs))
+		for i, size := range test.bufs {
+			bufs[i] = make([]byte, 0, size)
+		}
+		incoming.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := incoming.ReadBatch(bufs)
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v, expected error=%v", test.name, err, test.err)
+		}
+		var got []string
+		for _, buf := range bufs[:n] {
+			got = append(got, string(buf))
+		}
+		if strings.Join(got, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%s: read %q, expected %q", test.name, got, test.expected)
+		}
+	}
+}
+
+// Checks that a Read which is waiting for traffic returns as soon as the session
+// is closed, with an error that says why it was closed.
+func TestReadClosed(t *testing.T) {
+	tests := []struct {
+		name     string
+		deadline bool // Read with a deadline set, which isn't reached
+		remote   bool // The remote end closes the session, rather than us
+		reason   string
+	}{
+		{"closed locally", false, false, "connection closed"},
+		{"closed locally with a deadline", true, false, "connection closed"},
+		{"closed remotely", false, true, errSessionClosedRemotely.Error()},
+	}
+	for _, test := range tests {
+		a, b := newTestCore(t, nil), newTestCore(t, nil)
+		peerTestCores(t, a, b)
+		listener, err := a.ConnListen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		outgoing := dialTestCore(t, b, a)
+		incoming := acceptTestConn(t, listener)
+		checkTestTraffic(t, outgoing, incoming, "hello")
+		if test.deadline {
+			incoming.SetReadDeadline(time.Now().Add(time.Minute))
+		}
+		result := make(chan error, 1)
+		go func() {
+			_, err := incoming.Read(make([]byte, 16))
+			result <- err
+		}()
+		// Give the Read time to start waiting
+		time.Sleep(100 * time.Millisecond)
+		if test.remote {
+			outgoing.Close()
+		} else {
+			incoming.Close()
+		}
+		select {
+		case err := <-result:
+			if e, ok := err.(ConnError); !ok || !e.Closed() {
+				t.Errorf("%s: got error %v, expected a closed error", test.name, err)
+			} else if !strings.Contains(err.Error(), test.reason) {
+				t.Errorf("%s: got error %q, expected the reason %q", test.name, err, test.reason)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: Read didn't return after the session was closed", test.name)
+		}
+		a.Stop()
+		b.Stop()
+	}
+}
+
+func TestStaleKeyGrace(t *testing.T) {
+	start := time.Unix(1000000, 0)
+	now := start
+	sinfo := newTestSessionInfo(&now)
+	oldKey, newKey := crypto.BoxSharedKey{1}, crypto.BoxSharedKey{2}
+	sinfo.sharedSesKey = oldKey
+	sinfo.updateNonce(testNonce(10))
+	sinfo.retireSesKey(time.Second)
+	sinfo.sharedSesKey = newKey
+	sinfo.theirNonce = crypto.BoxNonce{}
+	sinfo.theirNonceHeap = nil
+	sinfo.theirNonceMap = make(map[crypto.BoxNonce]time.Time)
+	tests := []struct {
+		name     string
+		at       time.Duration // Since the key was retired
+		expire   bool          // Call expirePrevKey first, as the recv worker does
+		nonce    uint64
+		nonceOK  bool // Expected from prevNonceIsOK
+		accepted bool // Expected from acceptPacket, if the nonce was OK
+		drop     sessionDropReason
+	}{
+		{"in flight", 100 * time.Millisecond, true, 11, true, true, 0},
+		{"replayed", 200 * time.Millisecond, true, 11, false, false, 0},
+		{"already seen", 300 * time.Millisecond, true, 10, false, false, 0},
+		{"expired while decrypting", 1500 * time.Millisecond, false, 12, true, false, dropStaleKey},
+		{"after grace", 1500 * time.Millisecond, true, 13, false, false, 0},
+	}
+	for _, test := range tests {
+		now = start.Add(test.at)
+		if test.expire {
+			sinfo.expirePrevKey()
+		}
+		nonce := testNonce(test.nonce)
+		if ok := sinfo.prevNonceIsOK(nonce); ok != test.nonceOK {
+			t.Errorf("%s: got nonce ok=%v, expected %v", test.name, ok, test.nonceOK)
+			continue
+		} else if !ok {
+			continue
+		}
+		drops := sinfo.drops
+		r := sessionRecvPacket{
+			packet:  wire_trafficPacket{Nonce: *nonce},
+			key:     newKey,
+			prevKey: oldKey,
+			isOK:    true,
+			isStale: true,
+		}
+		if accepted := sinfo.acceptPacket(&r); accepted != test.accepted {
+			t.Errorf("%s: got accepted=%v, expected %v", test.name, accepted, test.accepted)
+		} else if !accepted && sinfo.drops[test.drop] != drops[test.drop]+1 {
+			t.Errorf("%s: the drop wasn't counted as %s", test.name, sessionDropReasonNames[test.drop])
+		}
+	}
+	if sinfo.hasPrevSesKey || sinfo.prevSesKey != (crypto.BoxSharedKey{}) {
+		t.Error("the previous key was kept after the grace window")
+	}
+	if sinfo.staleKeyRecvd != 1 {
+		t.Errorf("accepted %d packets under the previous key, expected 1", sinfo.staleKeyRecvd)
+	}
+}
+
+// Makes a sessions struct with just enough set up to use the shared key cache.
+func newTestSharedKeyCache() *sessions {
+	ss := &sessions{now: time.Now}
+	ss.permShared = make(map[crypto.BoxPubKey]*permSharedEntry)
+	return ss
+}
+
+func BenchmarkGetSharedKeyCached(b *testing.B) {
+	ss := newTestSharedKeyCache()
+	_, myPriv := crypto.NewBoxKeys()
+	theirPub, _ := crypto.NewBoxKeys()
+	ss.getSharedKey(myPriv, theirPub)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ss.getSharedKey(myPriv, theirPub)
+		}
+	})
+}
+
+func BenchmarkGetSharedKeyUncached(b *testing.B) {
+	ss := newTestSharedKeyCache()
+	_, myPriv := crypto.NewBoxKeys()
+	theirPubs := make([]*crypto.BoxPubKey, 256)
+	for i := range theirPubs {
+		theirPubs[i], _ = crypto.NewBoxKeys()
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Empty the cache each time, so that every key has to be computed
+		if i%len(theirPubs) == 0 {
+			ss.permShared = make(map[crypto.BoxPubKey]*permSharedEntry)
+		}
+		ss.getSharedKey(myPriv, theirPubs[i%len(theirPubs)])
+	}
+}
+
+func TestNodeTrafficTotals(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	ss := sessions{
+		now:            func() time.Time { return now },
+		sinfos:         make(map[crypto.Handle]*sessionInfo),
+		lastTotalsTime: now,
+	}
+	ss.closedTotals.bytesSent = 1000
+	ss.closedTotals.drops[dropDecryptFailed] = 3
+	first, second := &sessionInfo{bytesSent: 100, bytesRecvd: 200}, &sessionInfo{bytesRecvd: 50}
+	first.drops[dropInvalidNonce] = 1
+	second.drops[dropDecryptFailed] = 2
+	ss.sinfos[crypto.Handle{1}] = first
+	ss.sinfos[crypto.Handle{2}] = second
+	tests := []struct {
+		name       string
+		elapsed    time.Duration
+		sent       uint64 // Added to the first session before getting the totals
+		recvd      uint64
+		totalSent  uint64
+		totalRecvd uint64
+		sendRate   float64
+		recvRate   float64
+	}{
+		{"open and closed", time.Second, 0, 0, 1100, 250, 1100, 250},
+		{"since the last call", 2 * time.Second, 400, 100, 1500, 350, 200, 50},
+		{"idle", 10 * time.Second, 0, 0, 1500, 350, 0, 0},
+	}
+	for _, test := range tests {
+		now = now.Add(test.elapsed)
+		first.bytesSent += test.sent
+		first.bytesRecvd += test.recvd
+		stats := ss.getTotals()
+		switch {
+		case stats.Sessions != 2:
+			t.Errorf("%s: got %d sessions", test.name, stats.Sessions)
+		case stats.BytesSent != test.totalSent || stats.BytesRecvd != test.totalRecvd:
+			t.Errorf("%s: got %d sent and %d received", test.name, stats.BytesSent, stats.BytesRecvd)
+		case stats.SendRate != test.sendRate || stats.RecvRate != test.recvRate:
+			t.Errorf("%s: got rates of %v sent and %v received", test.name, stats.SendRate, stats.RecvRate)
+		case stats.Drops["invalid_nonce"] != 1 || stats.Drops["decrypt_failed"] != 5:
+			t.Errorf("%s: got drops %v", test.name, stats.Drops)
+		}
+	}
+}
+
+func TestCallbackPressure(t *testing.T) {
+	tests := []struct {
+		name     string
+		global   int // Outstanding callbacks across all sessions
+		pending  int // Outstanding callbacks of the session asking
+		expected bool
+	}{
+		{"idle", 0, 0, false},
+		{"busy session", maxCallbacks / 2, maxCallbacks / 2, false},
+		{"at the cap", maxCallbacks, minCallbacksUnderPressure, true},
+		{"over the cap", maxCallbacks * 2, maxCallbacks, true},
+		{"quiet session at the cap", maxCallbacks, minCallbacksUnderPressure - 1, false},
+	}
+	for _, test := range tests {
+		var ss sessions
+		ss.addCallbacks(test.global)
+		if result := ss.isUnderPressure(test.pending); result != test.expected {
+			t.Errorf("%s: got under pressure=%v, expected %v", test.name, result, test.expected)
+		}
+	}
+}
+
+// Puts a node at the callback cap, as if lots of other sessions were busy, and
+// checks that a session still gets its traffic through while backpressure is
+// applied, and that its callbacks are all accounted for afterwards.
+func TestCallbackPressureTraffic(t *testing.T) {
+	a, b := newTestCore(t, nil), newTestCore(t, nil)
+	defer a.Stop()
+	defer b.Stop()
+	peerTestCores(t, a, b)
+	listener, err := b.ConnListen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outgoing := dialTestCore(t, a, b)
+	incoming := acceptTestConn(t, listener)
+	checkTestTraffic(t, outgoing, incoming, "before the cap")
+
+	b.sessions.addCallbacks(maxCallbacks)
+	buf := make([]byte, 65535)
+	for round := 0; round < 10; round++ {
+		// Enough at once for the session to have to wait for its own callbacks,
+		// but not so many that the Conn's buffer overflows
+		const burst = 2 * minCallbacksUnderPressure
+		for i := 0; i < burst; i++ {
+			if _, err := outgoing.Write([]byte("under pressure")); err != nil {
+				t.Fatal("write failed:", err)
+			}
+		}
+		for i := 0; i < burst; i++ {
+			incoming.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := incoming.Read(buf); err != nil {
+				t.Fatalf("round %d: read %d packets before failing: %v", round, i, err)
+			}
+		}
+	}
+	outgoing.Close()
+	incoming.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if callbacks := b.GetNodeTrafficStats().Callbacks; callbacks == maxCallbacks {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("%d callbacks outstanding after the session closed, expected %d", callbacks, maxCallbacks)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestSessionEvents(t *testing.T) {
+	a, b := newTestCore(t, nil), newTestCore(t, nil)
+	defer a.Stop()
+	defer b.Stop()
+	peerTestCores(t, a, b)
+	events := make(chan SessionEvent, 4)
+	b.SubscribeSessionEvents(events)
+	// Nothing ever reads from this one, which mustn't hold anything up
+	b.SubscribeSessionEvents(make(chan SessionEvent))
+	listener, err := b.ConnListen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outgoing := dialTestCore(t, a, b)
+	incoming := acceptTestConn(t, listener)
+	checkTestTraffic(t, outgoing, incoming, "with events")
+	incoming.Close()
+	for _, expected := range []SessionEventType{SessionOpened, SessionClosed} {
+		select {
+		case event := <-events:
+			if event.Type != expected || event.PublicKey != a.boxPub {
+				t.Fatalf("got event %+v, expected type %d for the other node", event, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for event type %d", expected)
+		}
+	}
+	var established uint64
+	b.router.doAdmin(func() {
+		established, _ = b.sessions.getEstablishments()
+	})
+	if established != 1 {
+		t.Errorf("counted %d sessions as established, expected 1", established)
+	}
+}
+
+func TestSessionCloseIndexes(t *testing.T) {
+	tests := []struct {
+		name     string
+		replaced bool // Another session with the same node took over the indexes
+	}{
+		{"only session", false},
+		{"replaced", true},
+	}
+	for _, test := range tests {
+		now := time.Unix(1000000, 0)
+		old := newTestSessionInfo(&now)
+		ss := &old.core.sessions
+		ss.sinfos = make(map[crypto.Handle]*sessionInfo)
+		ss.byTheirPerm = make(map[crypto.BoxPubKey]*crypto.Handle)
+		ss.byTheirAddr = make(map[address.Address]*crypto.Handle)
+		ss.byTheirSubnet = make(map[address.Subnet]*crypto.Handle)
+		theirPerm, _ := crypto.NewBoxKeys()
+		index := func(sinfo *sessionInfo) {
+			sinfo.myHandle = *crypto.NewHandle()
+			sinfo.theirPermPub = *theirPerm
+			sinfo.theirAddr = *address.AddrForNodeID(crypto.GetNodeID(theirPerm))
+			sinfo.theirSubnet = *address.SubnetForNodeID(crypto.GetNodeID(theirPerm))
+			ss.sinfos[sinfo.myHandle] = sinfo
+			ss.byTheirPerm[sinfo.theirPermPub] = &sinfo.myHandle
+			ss.byTheirAddr[sinfo.theirAddr] = &sinfo.myHandle
+			ss.byTheirSubnet[sinfo.theirSubnet] = &sinfo.myHandle
+		}
+		index(old)
+		var survivor *sessionInfo
+		if test.replaced {
+			survivor = &sessionInfo{core: old.core, init: make(chan struct{})}
+			index(survivor)
+		}
+		old.close()
+		if _, isIn := ss.sinfos[old.myHandle]; isIn {
+			t.Errorf("%s: the closed session is still indexed by handle", test.name)
+		}
+		byPerm, _ := ss.getByTheirPerm(theirPerm)
+		byAddr, _ := ss.getByAddress(&old.theirAddr)
+		bySubnet, _ := ss.getBySubnet(&old.theirSubnet)
+		if byPerm != survivor || byAddr != survivor || bySubnet != survivor {
+			t.Errorf("%s: got sessions %p, %p and %p from the indexes, expected %p", test.name, byPerm, byAddr, bySubnet, survivor)
+		}
+	}
+}
+
+func TestSessionPingRejection(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	sinfo := newTestSessionInfo(&now)
+	sinfo.core.sessions.maxPingSkew = time.Minute
+	theirPerm, _ := crypto.NewBoxKeys()
+	otherPerm, _ := crypto.NewBoxKeys()
+	theirSes, _ := crypto.NewBoxKeys()
+	sinfo.theirPermPub = *theirPerm
+	sinfo.tstamp = now.Unix() - 10
+	tests := []struct {
+		name     string
+		perm     *crypto.BoxPubKey
+		tstamp   int64 // Relative to now
+		expected sessionPingResult
+	}{
+		{"same tstamp", theirPerm, -10, pingReplayed},
+		{"older tstamp", theirPerm, -20, pingReplayed},
+		{"too far ahead", theirPerm, 61, pingFromFuture},
+		{"other node", otherPerm, 0, pingHandleCollision},
+		{"newer tstamp", theirPerm, 0, pingAccepted},
+		{"replayed", theirPerm, 0, pingReplayed},
+		{"within skew", theirPerm, 60, pingAccepted},
+	}
+	for _, test := range tests {
+		ping := sessionPing{
+			SendPermPub: *test.perm,
+			SendSesPub:  *theirSes,
+			Tstamp:      now.Unix() + test.tstamp,
+		}
+		last := sinfo.tstamp
+		if result := sinfo.update(&ping); result != test.expected {
+			t.Errorf("%s: got %s, expected %s", test.name, sessionPingResultNames[result], sessionPingResultNames[test.expected])
+		} else if result != pingAccepted && sinfo.tstamp != last {
+			t.Errorf("%s: the rejected ping changed the session", test.name)
+		}
+	}
+	select {
+	case <-sinfo.init:
+	default:
+		t.Error("accepting a ping didn't initialize the session")
+	}
+}
+
+func TestNextTstamp(t *testing.T) {
+	start := time.Unix(1000000, 0)
+	now := start
+	sinfo := newTestSessionInfo(&now)
+	tests := []struct {
+		at       time.Duration // Since start
+		expected int64         // Relative to start
+	}{
+		{0, 0},
+		{100 * time.Millisecond, 1}, // Same second, so one ahead
+		{200 * time.Millisecond, 2},
+		{5 * time.Second, 5}, // Back in step with the clock
+		{4 * time.Second, 6}, // The clock went backwards
+		{10 * time.Second, 10},
+	}
+	for _, test := range tests {
+		now = start.Add(test.at)
+		if tstamp := sinfo.nextTstamp() - start.Unix(); tstamp != test.expected {
+			t.Errorf("at %v: got tstamp %d, expected %d", test.at, tstamp, test.expected)
+		}
+	}
+}
+
+func TestRotateKeysQuickly(t *testing.T) {
+	a := newTestCore(t, func(cfg *config.NodeConfig) {
+		// Packets that were already on their way when the keys changed are OK
+		cfg.SessionOptions.StaleKeyGracePeriod = 1000
+	})
+	b := newTestCore(t, func(cfg *config.NodeConfig) {
+		// Every packet is over the limit, but keys only rotate once per second
+		cfg.SessionOptions.KeyRotationBytes = 1
+	})
+	defer a.Stop()
+	defer b.Stop()
+	peerTestCores(t, a, b)
+	listener, err := a.ConnListen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outgoing := dialTestCore(t, b, a)
+	incoming := acceptTestConn(t, listener)
+	// Rotate straight away, in the same second as the handshake
+	outgoing.session.requestRotate()
+	var firstKey crypto.BoxPubKey
+	outgoing.session.doFunc(func() { firstKey = outgoing.session.mySesPub })
+	for start := time.Now(); time.Since(start) < 2500*time.Millisecond; {
+		checkTestTraffic(t, outgoing, incoming, "rotating")
+		checkTestTraffic(t, incoming, outgoing, "reply")
+	}
+	var keyTime time.Time
+	var key crypto.BoxPubKey
+	outgoing.session.doFunc(func() { key, keyTime = outgoing.session.mySesPub, outgoing.session.keyTime })
+	if key == firstKey || time.Since(keyTime) > 1500*time.Millisecond {
+		t.Fatal("the session keys weren't rotated")
+	}
+}
+
+func TestTraceIDs(t *testing.T) {
+	a, b := newTestCore(t, nil), newTestCore(t, nil)
+	defer a.Stop()
+	defer b.Stop()
+	peerTestCores(t, a, b)
+	listener, err := a.ConnListen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outgoing := dialTestCore(t, b, a)
+	incoming := acceptTestConn(t, listener)
+	if err := b.SetSessionFeature(a.boxPub, "no_such_feature", true); err == nil {
+		t.Fatal("set an unknown session feature")
+	}
+	buf := make([]byte, 65535)
+	tests := []struct {
+		name    string
+		enabled bool
+		traceID uint64
+		message []byte
+		read    uint64 // Trace ID that should be read
+	}{
+		// Messages starting with what looks like a trace header must arrive intact
+		{"disabled", false, 42, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 0},
+		{"enabled", true, 42, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 42},
+		{"without an ID", true, 0, []byte{0, 1, 2}, 0},
+		{"disabled again", false, 42, []byte{0, 1, 2}, 0},
+	}
+	for _, test := range tests {
+		if err := b.SetSessionFeature(a.boxPub, sessionFeatureTraceIDs, test.enabled); err != nil {
+			t.Fatal(err)
+		}
+		// The remote end finds out from the ping with the new session key
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			var theirs bool
+			incoming.session.doFunc(func() { theirs = incoming.session.theirTraceIDs })
+			if theirs == test.enabled {
+				break
+			} else if time.Now().After(deadline) {
+				t.Fatalf("%s: the remote end wasn't told about trace IDs", test.name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if _, err := outgoing.WriteWithTraceID(test.message, test.traceID); err != nil {
+			t.Fatal(err)
+		}
+		incoming.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, traceID, err := incoming.ReadWithTraceID(buf)
+		switch {
+		case err != nil:
+			t.Fatalf("%s: %v", test.name, err)
+		case !bytes.Equal(buf[:n], test.message):
+			t.Errorf("%s: read %v, expected %v", test.name, buf[:n], test.message)
+		case traceID != test.read:
+			t.Errorf("%s: read trace ID %d, expected %d", test.name, traceID, test.read)
+		}
+	}
+}
+
+func TestSharedKeyCacheEviction(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	ss := newTestSharedKeyCache()
+	ss.now = func() time.Time { return now }
+	_, myPriv := crypto.NewBoxKeys()
+	const maxKeys = 1024 // As in getSharedKey
+	keys := make([]*crypto.BoxPubKey, maxKeys+2)
+	for i := range keys {
+		keys[i], _ = crypto.NewBoxKeys()
+	}
+	for _, key := range keys[:maxKeys] {
+		now = now.Add(time.Second)
+		ss.getSharedKey(myPriv, key)
+	}
+	tests := []struct {
+		name    string
+		use     *crypto.BoxPubKey
+		evicted *crypto.BoxPubKey
+	}{
+		// Using the oldest key makes it the most recently used
+		{"used again", keys[0], nil},
+		{"first new key", keys[maxKeys], keys[1]},
+		{"second new key", keys[maxKeys+1], keys[2]},
+	}
+	for _, test := range tests {
+		now = now.Add(time.Second)
+		ss.getSharedKey(myPriv, test.use)
+		if len(ss.permShared) > maxKeys {
+			t.Errorf("%s: the cache grew to %d keys", test.name, len(ss.permShared))
+		}
+		if _, isIn := ss.permShared[*test.use]; !isIn {
+			t.Errorf("%s: the key wasn't cached", test.name)
+		}
+		if test.evicted == nil {
+			continue
+		}
+		if _, isIn := ss.permShared[*test.evicted]; isIn {
+			t.Errorf("%s: the least recently used key wasn't evicted", test.name)
+		}
+	}
+	if _, isIn := ss.permShared[*keys[0]]; !isIn {
+		t.Error("a recently used key was evicted")
+	}
+}
+
+// Checks that stopping a node which never finished starting returns, rather
+// than waiting forever for the router to close its sessions.
+func TestStopNotStarted(t *testing.T) {
+	tests := []struct {
+		name  string
+		start func(*Core)
+	}{
+		{"never started", func(*Core) {}},
+		{"failed to start", func(core *Core) {
+			cfg := config.GenerateConfig()
+			cfg.AdminListen = "none"
+			cfg.Listen = []string{"tcp://127.0.0.1"} // No port
+			if _, err := core.Start(cfg, log.New(ioutil.Discard, "", 0)); err == nil {
+				t.Fatal("started a node with an invalid listen address")
+			}
+		}},
+	}
+	for _, test := range tests {
+		core := new(Core)
+		test.start(core)
+		stopped := make(chan struct{})
+		go func() {
+			core.Stop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: Stop didn't return", test.name)
+		}
+	}
+}
+
+// Sends a session a ping from the same node after it restarted, which is to say
+// with a new session key and handle, and a tstamp that may have gone backwards.
+func TestSessionRestartPing(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	sinfo := newTestSessionInfo(&now)
+	sinfo.staleKeyGrace = time.Second
+	_, mySesPriv := crypto.NewBoxKeys()
+	sinfo.mySesPriv = *mySesPriv
+	theirPerm, _ := crypto.NewBoxKeys()
+	sinfo.theirPermPub = *theirPerm
+	tests := []struct {
+		name     string
+		tstamp   int64 // Relative to now
+		restart  bool  // Use a new session key and handle, as if the node restarted
+		expected sessionPingResult
+	}{
+		{"before restart", 0, false, pingAccepted},
+		{"same second", 0, true, pingReplayed},
+		{"reset tstamp", -3600, true, pingReplayed},
+		{"later tstamp", 1, true, pingAccepted},
+		{"restarted again", 2, true, pingAccepted},
+	}
+	var theirSes *crypto.BoxPubKey
+	var handle *crypto.Handle
+	for _, test := range tests {
+		if theirSes == nil || test.restart {
+			theirSes, _ = crypto.NewBoxKeys()
+			handle = crypto.NewHandle()
+		}
+		sinfo.updateNonce(testNonce(10))
+		oldSes, oldKey := sinfo.theirSesPub, sinfo.sharedSesKey
+		ping := sessionPing{
+			SendPermPub: *theirPerm,
+			Handle:      *handle,
+			SendSesPub:  *theirSes,
+			Tstamp:      now.Unix() + test.tstamp,
+		}
+		result := sinfo.update(&ping)
+		switch {
+		case result != test.expected:
+			t.Errorf("%s: got %s, expected %s", test.name, sessionPingResultNames[result], sessionPingResultNames[test.expected])
+		case result != pingAccepted && (sinfo.theirSesPub != oldSes || sinfo.sharedSesKey != oldKey):
+			t.Errorf("%s: the rejected ping changed the session key", test.name)
+		case result != pingAccepted:
+		case sinfo.theirSesPub != *theirSes || sinfo.theirHandle != *handle:
+			t.Errorf("%s: the session didn't switch to the new key and handle", test.name)
+		case sinfo.sharedSesKey != *crypto.GetSharedKey(&sinfo.mySesPriv, theirSes):
+			t.Errorf("%s: the shared key wasn't derived from the new key", test.name)
+		case len(sinfo.theirNonceMap) != 0 || sinfo.theirNonce != (crypto.BoxNonce{}):
+			t.Errorf("%s: the nonce state wasn't reset", test.name)
+		case oldSes != (crypto.BoxPubKey{}) && (!sinfo.hasPrevSesKey || sinfo.prevSesKey != oldKey):
+			t.Errorf("%s: the key from before the restart wasn't kept for the grace period", test.name)
+		}
+	}
+}
+
+// Restarts one end of a session without it closing the session first, as if
+// it crashed, and checks that the other end picks the session back up once the
+// restarted node reconnects.
+func TestSessionRestart(t *testing.T) {
+	cfg := config.GenerateConfig()
+	sameKeys := func(restarted *config.NodeConfig) {
+		restarted.EncryptionPublicKey = cfg.EncryptionPublicKey
+		restarted.EncryptionPrivateKey = cfg.EncryptionPrivateKey
+		restarted.SigningPublicKey = cfg.SigningPublicKey
+		restarted.SigningPrivateKey = cfg.SigningPrivateKey
+	}
+	a, b := newTestCore(t, sameKeys), newTestCore(t, nil)
+	defer b.Stop()
+	peerTestCores(t, a, b)
+	listener, err := b.ConnListen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outgoing := dialTestCore(t, a, b)
+	incoming := acceptTestConn(t, listener)
+	checkTestTraffic(t, outgoing, incoming, "before restarting")
+	checkTestTraffic(t, incoming, outgoing, "reply before restarting")
+
+	// Cut the peering first, so that the session close never reaches b
+	for _, peer := range a.GetPeers() {
+		a.DisconnectPeer(peer.Port)
+	}
+	a.Stop()
+	sinfo, isIn := b.sessions.getByTheirPerm(&a.boxPub)
+	if !isIn {
+		t.Fatal("the session was closed before the node restarted")
+	}
+	var lastTstamp int64
+	var lastSes crypto.BoxPubKey
+	sinfo.doFunc(func() {
+		lastTstamp, lastSes = atomic.LoadInt64(&sinfo.tstamp), sinfo.theirSesPub
+	})
+	// Tstamps are in seconds, so a node restarting within the same second as its
+	// last ping can't be told apart from a replay
+	time.Sleep(time.Until(time.Unix(lastTstamp+1, 0)))
+
+	restarted := newTestCore(t, sameKeys)
+	defer restarted.Stop()
+	peerTestCores(t, restarted, b)
+	outgoing = dialTestCore(t, restarted, b)
+	checkTestTraffic(t, outgoing, incoming, "after restarting")
+	checkTestTraffic(t, incoming, outgoing, "reply after restarting")
+	if s, _ := b.sessions.getByTheirPerm(&restarted.boxPub); s != sinfo {
+		t.Error("a new session was created instead of recovering the old one")
+	}
+	sinfo.doFunc(func() {
+		if sinfo.theirSesPub == lastSes {
+			t.Error("the session didn't switch to the restarted node's key")
+		}
+	})
+}
+
+// Uses the shared key cache from several goroutines at once, while sessions
+// are opened and closed and the router cleans up. Run with -race to check the
+// locking around permShared.
+func TestSharedKeyCacheConcurrent(t *testing.T) {
+	a, b := newTestCore(t, nil), newTestCore(t, nil)
+	defer a.Stop()
+	defer b.Stop()
+	peerTestCores(t, a, b)
+	listener, err := a.ConnListen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	theirPubs := make([]*crypto.BoxPubKey, 64)
+	for i := range theirPubs {
+		theirPubs[i], _ = crypto.NewBoxKeys()
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := i; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				skey := a.sessions.getSharedKey(&a.boxPriv, theirPubs[n%len(theirPubs)])
+				if *skey != *crypto.GetSharedKey(&a.boxPriv, theirPubs[n%len(theirPubs)]) {
+					t.Error("got the wrong shared key")
+					return
+				}
+				switch n % 16 {
+				case 0:
+					a.router.doAdmin(a.sessions.cleanup)
+				case 8:
+					a.sessions.flushPermShared()
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 5; i++ {
+		dialTestCore(t, b, a).Close()
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestFlowAffinityEviction(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	ss := sessions{
+		now:          func() time.Time { return now },
+		flowAffinity: make(map[uint64]*flowAffinityEntry),
+	}
+	node := func(flowKey uint64) crypto.NodeID {
+		var nodeID crypto.NodeID
+		binary.BigEndian.PutUint64(nodeID[:], flowKey)
+		return nodeID
+	}
+	for flowKey := uint64(0); flowKey < maxFlowAffinities; flowKey++ {
+		now = now.Add(time.Second)
+		ss.setFlowAffinity(flowKey, node(flowKey))
+	}
+	// Dialing the oldest flow again makes it the most recently used
+	now = now.Add(time.Second)
+	if pinned, isPinned := ss.getFlowAffinity(0); !isPinned || pinned != node(0) {
+		t.Fatal("the flow wasn't remembered")
+	}
+	tests := []struct {
+		name      string
+		set       uint64
+		forgotten []uint64
+		kept      []uint64
+	}{
+		{"new flow", maxFlowAffinities, []uint64{1}, []uint64{0, 2}},
+		{"another new flow", maxFlowAffinities + 1, []uint64{2}, []uint64{0, 3}},
+		// Moving a flow that's already remembered doesn't forget any others
+		{"moved flow", maxFlowAffinities, nil, []uint64{0, 3}},
+	}
+	for _, test := range tests {
+		now = now.Add(time.Second)
+		ss.setFlowAffinity(test.set, node(test.set+1))
+		if len(ss.flowAffinity) > maxFlowAffinities {
+			t.Fatalf("%s: remembered %d flows", test.name, len(ss.flowAffinity))
+		}
+		if pinned, _ := ss.getFlowAffinity(test.set); pinned != node(test.set+1) {
+			t.Errorf("%s: the flow wasn't connected to the new node", test.name)
+		}
+		for _, flowKey := range test.forgotten {
+			if _, isPinned := ss.flowAffinity[flowKey]; isPinned {
+				t.Errorf("%s: flow %d wasn't forgotten", test.name, flowKey)
+			}
+		}
+		for _, flowKey := range test.kept {
+			if _, isPinned := ss.flowAffinity[flowKey]; !isPinned {
+				t.Errorf("%s: flow %d was forgotten", test.name, flowKey)
+			}
+		}
+	}
+}
+
+func TestDialFlowContext(t *testing.T) {
+	core := newTestCore(t, nil)
+	defer core.Stop()
+	dialer, err := core.ConnDialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// There's nobody to dial, so this only returns once the deadline passes
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	var nodeID, nodeMask crypto.NodeID
+	nodeID[0], nodeMask[0] = 0x12, 0xff
+	start := time.Now()
+	_, err = dialer.DialFlowContext(ctx, 1, &nodeID, &nodeMask)
+	if e, ok := err.(ConnError); !ok || !e.Timeout() {
+		t.Fatalf("expected a timeout ConnError, got %#v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatal("the dial didn't give up at the deadline, took", elapsed)
+	}
+}
+
+// Checks that a session close is only acted on if it's from the current session
+// with the remote node, and newer than the last ping from it.
+func TestHandleClose(t *testing.T) {
+	tests := []struct {
+		name   string
+		handle bool  // The close has the handle from the remote end's pings
+		tstamp int64 // Relative to the last ping
+		closed bool
+	}{
+		{"newer close", true, 1, true},
+		{"same tstamp as the last ping", true, 0, false},
+		{"older than the last ping", true, -1, false},
+		{"other handle", false, 1, false},
+	}
+	for _, test := range tests {
+		now := time.Unix(1000000, 0)
+		sinfo := newTestSessionInfo(&now)
+		sinfo.cancel = util.NewCancellation()
+		sinfo.myHandle = *crypto.NewHandle()
+		sinfo.theirHandle = *crypto.NewHandle()
+		theirPerm, _ := crypto.NewBoxKeys()
+		sinfo.theirPermPub = *theirPerm
+		sinfo.tstamp = now.Unix()
+		ss := &sinfo.core.sessions
+		ss.sinfos = map[crypto.Handle]*sessionInfo{sinfo.myHandle: sinfo}
+		ss.byTheirPerm = map[crypto.BoxPubKey]*crypto.Handle{*theirPerm: &sinfo.myHandle}
+		msg := sessionClose{
+			SendPermPub: *theirPerm,
+			Handle:      *crypto.NewHandle(),
+			Tstamp:      now.Unix() + test.tstamp,
+		}
+		if test.handle {
+			msg.Handle = sinfo.theirHandle
+		}
+		ss.handleClose(&msg)
+		if _, isIn := ss.sinfos[sinfo.myHandle]; isIn == test.closed {
+			t.Errorf("%s: got closed=%v, expected %v", test.name, !isIn, test.closed)
+		}
+	}
+}
+
+func TestRateLimiterTake(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	var limiter sessionRateLimiter
+	tests := []struct {
+		name    string
+		elapsed time.Duration // Before taking the tokens
+		size    int
+		rate    uint64
+		burst   uint64
+		wait    time.Duration
+	}{
+		{"full bucket", 0, 500, 1000, 0, 0},
+		{"rest of the bucket", 0, 500, 1000, 0, 0},
+		{"over the rate", 0, 500, 1000, 0, 500 * time.Millisecond},
+		{"paid back", time.Second, 0, 1000, 0, 0},
+		{"refilled up to the burst", 10 * time.Second, 1500, 1000, 0, 500 * time.Millisecond},
+		{"limit changed", 0, 4000, 2000, 4000, 0},
+		{"over the new rate", 0, 2000, 2000, 4000, time.Second},
+	}
+	for _, test := range tests {
+		now = now.Add(test.elapsed)
+		if wait := limiter.take(now, test.size, test.rate, test.burst); wait != test.wait {
+			t.Errorf("%s: got a wait of %v, expected %v", test.name, wait, test.wait)
+		}
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	var limiter sessionRateLimiter
+	const limit = 10 // Packets per second
+	tests := []struct {
+		name    string
+		elapsed time.Duration // Before the packets
+		packets int
+		allowed int
+	}{
+		{"burst", 0, limit + 5, limit},
+		{"still empty", 0, 1, 0},
+		{"one refilled", time.Second / limit, 2, 1},
+		{"refused packets took nothing", time.Second / limit, 1, 1},
+		{"refilled up to the burst", time.Minute, limit * 2, limit},
+	}
+	for _, test := range tests {
+		now = now.Add(test.elapsed)
+		var allowed int
+		for i := 0; i < test.packets; i++ {
+			if limiter.allow(now, 1, limit, limit) {
+				allowed++
+			}
+		}
+		if allowed != test.allowed {
+			t.Errorf("%s: allowed %d of %d packets, expected %d", test.name, allowed, test.packets, test.allowed)
+		}
+	}
+}
+
+// Turns compression on and off at each end while traffic is flowing, which
+// mustn't leave the two ends disagreeing about which packets have a marker.
+func TestCompressionToggled(t *testing.T) {
+	configure := func(cfg *config.NodeConfig) {
+		cfg.SessionOptions.Compression = true
+		// Packets that were in flight when the keys changed are still fine
+		cfg.SessionOptions.StaleKeyGracePeriod = 1000
+	}
+	a, b := newTestCore(t, configure), newTestCore(t, configure)
+	defer a.Stop()
+	defer b.Stop()
+	peerTestCores(t, a, b)
+	listener, err := a.ConnListen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outgoing := dialTestCore(t, b, a)
+	incoming := acceptTestConn(t, listener)
+	setCompression := func(core *Core, compress bool) {
+		cfg := core.config.GetCurrent()
+		cfg.SessionOptions.Compression = compress
+		core.UpdateConfig(&cfg)
+	}
+	// Compressible, and long enough to be worth compressing
+	msg := bytes.Repeat([]byte("compress me "), 100)
+	buf := make([]byte, 65535)
+	tests := []struct {
+		name      string
+		aCompress bool
+		bCompress bool
+	}{
+		{"both", true, true},
+		{"off at one end", false, true},
+		{"off at both ends", false, false},
+		{"on at the other end", false, true},
+		{"on at both ends", true, true},
+		{"off at the other end", true, false},
+	}
+	for _, test := range tests {
+		setCompression(a, test.aCompress)
+		setCompression(b, test.bCompress)
+		// Straight away, before the pings with the new keys have arrived
+		for _, pair := range [][2]*Conn{{outgoing, incoming}, {incoming, outgoing}} {
+			for i := 0; i < 8; i++ {
+				if _, err := pair[0].Write(msg); err != nil {
+					t.Fatalf("%s: write failed: %v", test.name, err)
+				}
+			}
+			for i := 0; i < 8; i++ {
+				pair[1].SetReadDeadline(time.Now().Add(5 * time.Second))
+				n, err := pair[1].Read(buf)
+				if err != nil {
+					t.Fatalf("%s: read %d packets before failing: %v", test.name, i, err)
+				}
+				if !bytes.Equal(buf[:n], msg) {
+					t.Fatalf("%s: read %q", test.name, buf[:n])
+				}
+			}
+		}
+	}
+	for _, conn := range []*Conn{outgoing, incoming} {
+		conn.session.doFunc(func() {
+			if drops := conn.session.drops[dropBadCompression]; drops != 0 {
+				t.Errorf("dropped %d packets with bad compression", drops)
+			}
+		})
+	}
+}
+
+// Checks that a node with compression on can still talk to a node from before
+// compression was added, which doesn't advertise it, and doesn't know to look
+// for a compression marker.
+func TestCompressionOldPeer(t *testing.T) {
+	a := newTestCore(t, func(cfg *config.NodeConfig) {
+		cfg.SessionOptions.Compression = true
+	})
+	b := newTestCore(t, nil)
+	defer a.Stop()
+	defer b.Stop()
+	peerTestCores(t, a, b)
+	listener, err := a.ConnListen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outgoing := dialTestCore(t, b, a)
+	incoming := acceptTestConn(t, listener)
+	// An old node ignores the flags in our pings, so it never knows that we
+	// advertised compression
+	outgoing.session.doFunc(func() {
+		outgoing.session.theirCompress = false
+	})
+	incoming.session.doFunc(func() {
+		if incoming.session.usesCompression() {
+			t.Error("using compression with a node that didn't advertise it")
+		}
+	})
+	tests := []struct {
+		name string
+		msg  string
+	}{
+		{"short", "hello"},
+		{"compressible", strings.Repeat("compress me ", 100)},
+	}
+	for _, test := range tests {
+		checkTestTraffic(t, incoming, outgoing, test.msg)
+		checkTestTraffic(t, outgoing, incoming, test.msg)
+	}
+}
+
+func TestFlushSharedKeyCache(t *testing.T) {
+	ss := newTestSharedKeyCache()
+	_, myPriv := crypto.NewBoxKeys()
+	keys := make([]*crypto.BoxPubKey, 10)
+	for i := range keys {
+		keys[i], _ = crypto.NewBoxKeys()
+	}
+	tests := []struct {
+		name    string
+		cached  int // Keys to use before flushing
+		flushed int
+	}{
+		{"empty", 0, 0},
+		{"populated", len(keys), len(keys)},
+		{"some again", 3, 3},
+	}
+	for _, test := range tests {
+		for _, key := range keys[:test.cached] {
+			ss.getSharedKey(myPriv, key)
+		}
+		if flushed := ss.flushPermShared(); flushed != test.flushed {
+			t.Errorf("%s: flushed %d keys, expected %d", test.name, flushed, test.flushed)
+		}
+		if len(ss.permShared) != 0 {
+			t.Errorf("%s: %d keys were left in the cache", test.name, len(ss.permShared))
+		}
+	}
+	// Keys are derived again afterwards, and come out the same
+	for _, key := range keys {
+		if skey := ss.getSharedKey(myPriv, key); *skey != *crypto.GetSharedKey(myPriv, key) {
+			t.Fatal("got the wrong shared key after flushing")
+		}
+		if _, isIn := ss.permShared[*key]; !isIn {
+			t.Fatal("the shared key wasn't cached again after flushing")
+		}
+	}
+}
+
+func TestCheckOneWay(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	sinfo := newTestSessionInfo(&now)
+	sinfo.oneWayTime = now
+	ss := &sinfo.core.sessions
+	ss.core = sinfo.core
+	ss.sinfos = map[crypto.Handle]*sessionInfo{{1}: sinfo}
+	tests := []struct {
+		name    string
+		elapsed time.Duration // Before the check
+		sent    uint64        // Packets sent since the last check
+		recvd   uint64        // Packets received since the last check
+		oneWay  bool
+	}{
+		{"both ways", oneWayWindow, 100, 100, false},
+		{"one way", oneWayWindow, oneWayMinPackets, 0, true},
+		{"window not over", oneWayWindow / 2, 0, 10, true},
+		{"reply arrived", oneWayWindow / 2, oneWayMinPackets, 0, false},
+		{"sending now and then", oneWayWindow, oneWayMinPackets - 1, 0, false},
+		{"idle", oneWayWindow, 0, 0, false},
+		{"only receiving", oneWayWindow, 0, 100, false},
+	}
+	for _, test := range tests {
+		now = now.Add(test.elapsed)
+		sinfo.packetsSent += test.sent
+		sinfo.packetsRecvd += test.recvd
+		ss.checkOneWay()
+		if sinfo.isOneWay != test.oneWay {
+			t.Errorf("%s: got one way=%v, expected %v", test.name, sinfo.isOneWay, test.oneWay)
+		}
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	msg := func(flowKey uint64, n byte) FlowKeyMessage {
+		return FlowKeyMessage{FlowKey: flowKey, Message: []byte{n}}
+	}
+	tests := []struct {
+		name     string
+		pushed   []FlowKeyMessage
+		priority map[uint64]int // Priorities of the flows when they're pushed
+		popped   []FlowKeyMessage
+	}{
+		{
+			"fifo by default",
+			[]FlowKeyMessage{msg(1, 1), msg(2, 2), msg(1, 3)},
+			nil,
+			[]FlowKeyMessage{msg(1, 1), msg(2, 2), msg(1, 3)},
+		},
+		{
+			"higher priority first",
+			[]FlowKeyMessage{msg(1, 1), msg(1, 2), msg(2, 3)},
+			map[uint64]int{2: 2},
+			[]FlowKeyMessage{msg(2, 3), msg(1, 1), msg(1, 2)},
+		},
+		{
+			"flows stay in order",
+			[]FlowKeyMessage{msg(1, 1), msg(2, 2), msg(2, 3), msg(1, 4)},
+			map[uint64]int{1: 1, 2: 3},
+			[]FlowKeyMessage{msg(2, 2), msg(2, 3), msg(1, 1), msg(1, 4)},
+		},
+	}
+	for _, test := range tests {
+		var q sessionSendQueue
+		for _, m := range test.pushed {
+			q.push(m, test.priority[m.FlowKey])
+		}
+		for i, expected := range test.popped {
+			if got := q.pop(); got.FlowKey != expected.FlowKey || got.Message[0] != expected.Message[0] {
+				t.Errorf("%s: packet %d was %d from flow %d, expected %d from flow %d",
+					test.name, i, got.Message[0], got.FlowKey, expected.Message[0], expected.FlowKey)
+			}
+		}
+		if q.size != 0 {
+			t.Errorf("%s: %d packets were left in the queue", test.name, q.size)
+		}
+	}
+	// A low priority flow is held back, but never starved
+	var q sessionSendQueue
+	q.push(msg(1, 0), 0)
+	for i := 0; i < 2*maxPrioritySkips; i++ {
+		q.push(msg(2, byte(i)), MaxFlowPriority)
+	}
+	for i := 0; i <= maxPrioritySkips; i++ {
+		if q.pop().FlowKey == 1 {
+			if i != maxPrioritySkips {
+				t.Errorf("the low priority packet was sent after %d others, expected %d", i, maxPrioritySkips)
+			}
+			return
+		}
+	}
+	t.Error("the low priority packet was starved")
+}
+
+// Sends a high priority packet while lower priority ones are already queued,
+// and being held back by the rate limit, which should send it ahead of them.
+func TestSendPriorityLateArrival(t *testing.T) {
+	a := newTestCore(t, nil)
+	b := newTestCore(t, func(cfg *config.NodeConfig) {
+		cfg.SessionOptions.SendRateLimit = 4000
+		cfg.SessionOptions.SendRateBurst = 100
+	})
+	defer a.Stop()
+	defer b.Stop()
+	peerTestCores(t, a, b)
+	listener, err := a.ConnListen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outgoing := dialTestCore(t, b, a)
+	incoming := acceptTestConn(t, listener)
+	const bulkFlow, urgentFlow = 1, 2
+	if err := b.SetFlowPriority(urgentFlow, MaxFlowPriority); err != nil {
+		t.Fatal(err)
+	}
+	const bulk = 20
+	for i := 0; i < bulk; i++ {
+		if _, err := outgoing.WriteWithFlowKey(bytes.Repeat([]byte{0}, 100), bulkFlow); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Give the worker time to start on the bulk packets
+	time.Sleep(50 * time.Millisecond)
+	if _, err := outgoing.WriteWithFlowKey([]byte{1}, urgentFlow); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 65535)
+	for i := 0; i <= bulk; i++ {
+		incoming.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := incoming.Read(buf)
+		if err != nil {
+			t.Fatalf("read %d packets before failing: %v", i, err)
+		}
+		if n == 1 {
+			if i > bulk/2 {
+				t.Errorf("the urgent packet arrived after %d of %d bulk packets", i, bulk)
+			}
+			return
+		}
+	}
+	t.Error("the urgent packet never arrived")
+}
+
+func TestMaxHalfOpen(t *testing.T) {
+	core := newTestCore(t, func(cfg *config.NodeConfig) {
+		cfg.SessionOptions.MaxHalfOpen = 2
+	})
+	defer core.Stop()
+	tests := []struct {
+		name     string
+		close    int // Close the session created by this earlier test first, if not -1
+		refused  bool
+		halfOpen int
+	}{
+		{"first", -1, false, 1},
+		{"second", -1, false, 2},
+		{"over the limit", -1, true, 2},
+		{"one closed", 0, false, 2},
+		{"still over the limit", -1, true, 2},
+	}
+	created := make([]*sessionInfo, len(tests))
+	var refused uint64
+	for idx, test := range tests {
+		// None of these nodes exist, so the sessions stay half-open
+		theirPerm, _ := crypto.NewBoxKeys()
+		var err error
+		var halfOpen int
+		core.router.doAdmin(func() {
+			if test.close >= 0 {
+				created[test.close].close()
+			}
+			created[idx], err = core.sessions.createSession(theirPerm, true)
+			halfOpen = core.sessions.halfOpen
+		})
+		if (err != nil) != test.refused {
+			t.Errorf("%s: got error %v, expected refused=%v", test.name, err, test.refused)
+		}
+		if test.refused {
+			refused++
+		}
+		if halfOpen != test.halfOpen {
+			t.Errorf("%s: %d sessions are half-open, expected %d", test.name, halfOpen, test.halfOpen)
+		}
+	}
+	stats := core.GetSessionEstablishment()
+	if stats.HalfOpenRefused != refused {
+		t.Errorf("counted %d refused sessions, expected %d", stats.HalfOpenRefused, refused)
+	}
+	if sessions := core.GetHalfOpenSessions(); len(sessions) != 2 {
+		t.Errorf("got %d half-open sessions, expected 2", len(sessions))
+	}
+}
+
+// Opens a session between two new nodes, for benchmarking traffic through it.
+func newTestSession(b *testing.B) (a, c *Core, outgoing, incoming *Conn) {
+	a, c = newTestCore(b, nil), newTestCore(b, nil)
+	peerTestCores(b, a, c)
+	listener, err := a.ConnListen()
+	if err != nil {
+		b.Fatal(err)
+	}
+	outgoing = dialTestCore(b, c, a)
+	incoming = acceptTestConn(b, listener)
+	checkTestTraffic(b, outgoing, incoming, "before benchmarking")
+	return a, c, outgoing, incoming
+}
+
+// Measures how quickly packets can be written to a session, while the other
+// end reads them as fast as it can. Run with -mutexprofile to see how much the
+// send worker contends for the session mutex.
+func BenchmarkSessionSend(b *testing.B) {
+	for _, size := range []int{64, 1024} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			a, c, outgoing, incoming := newTestSession(b)
+			defer a.Stop()
+			defer c.Stop()
+			go func() {
+				buf := make([]byte, 65535)
+				for {
+					if _, err := incoming.Read(buf); err != nil {
+						return
+					}
+				}
+			}()
+			msg := make([]byte, size)
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := outgoing.Write(msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			incoming.Close()
+		})
+	}
+}
+
+// Measures how quickly packets can be read from a session, while the other end
+// writes them as fast as it can. Run with -mutexprofile to see how much the
+// recv worker contends for the session mutex.
+func BenchmarkSessionRecv(b *testing.B) {
+	for _, size := range []int{64, 1024} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			a, c, outgoing, incoming := newTestSession(b)
+			defer a.Stop()
+			defer c.Stop()
+			done := make(chan struct{})
+			go func() {
+				msg := make([]byte, size)
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					if _, err := outgoing.Write(msg); err != nil {
+						return
+					}
+				}
+			}()
+			buf := make([]byte, 65535)
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				incoming.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := incoming.Read(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			close(done)
+			outgoing.Close()
+		})
+	}
+}
+
+// Checks that the tstamp store only keeps the newest tstamps once there are
+// more than maxStoredTstamps of them.
+func TestTstampStoreCap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tstamps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Unix(1000000, 0)
+	tests := []struct {
+		name     string
+		stored   int
+		expected int
+	}{
+		{"under the cap", 10, 10},
+		{"at the cap", maxStoredTstamps, maxStoredTstamps},
+		{"over the cap", maxStoredTstamps + 10, maxStoredTstamps},
+	}
+	for _, test := range tests {
+		ss := &newTestSessionInfo(&now).core.sessions
+		ss.tstampStore = filepath.Join(dir, test.name)
+		ss.loadTstamps()
+		for i := 0; i < test.stored; i++ {
+			var key crypto.BoxPubKey
+			binary.BigEndian.PutUint64(key[:], uint64(i))
+			ss.tstamps[key] = int64(i + 1)
+		}
+		ss.saveTstamps()
+		ss.loadTstamps()
+		if len(ss.tstamps) != test.expected {
+			t.Errorf("%s: got %d tstamps, expected %d", test.name, len(ss.tstamps), test.expected)
+		}
+		for key, tstamp := range ss.tstamps {
+			if tstamp <= int64(test.stored-test.expected) {
+				t.Errorf("%s: kept tstamp %d for %x, which should have been forgotten", test.name, tstamp, key[:8])
+			}
+		}
+	}
+}
+
+// Checks that nonces are only forgotten by updateNonce once they've been
+// tracked for longer than the nonce window, going by the session clock.
+func TestNonceWindowEviction(t *testing.T) {
+	start := time.Unix(1000000, 0)
+	now := start
+	sinfo := newTestSessionInfo(&now)
+	sinfo.nonceHeapSize = 2
+	sinfo.nonceWindow = time.Second
+	tests := []struct {
+		at      time.Duration // Since start
+		nonce   uint64
+		tracked int    // Expected number of nonces tracked afterwards
+		oldest  uint64 // Expected oldest nonce tracked afterwards
+	}{
+		{0, 1, 1, 1},
+		{0, 2, 2, 1},
+		{0, 3, 3, 1},
+		// Over the heap size, but nothing has been tracked for a window yet
+		{500 * time.Millisecond, 4, 4, 1},
+		// Everything from the start has now been tracked for a window, but we
+		// stop forgetting once we're down to the heap size
+		{time.Second, 5, 3, 3},
+		{1200 * time.Millisecond, 6, 3, 4},
+		{1300 * time.Millisecond, 7, 4, 4},
+	}
+	for _, test := range tests {
+		now = start.Add(test.at)
+		sinfo.updateNonce(testNonce(test.nonce))
+		if len(sinfo.theirNonceHeap) != test.tracked || len(sinfo.theirNonceMap) != test.tracked {
+			t.Errorf("nonce %d: tracking %d in the heap and %d in the map, expected %d",
+				test.nonce, len(sinfo.theirNonceHeap), len(sinfo.theirNonceMap), test.tracked)
+		}
+		if oldest := sinfo.theirNonceHeap.peek(); *oldest != *testNonce(test.oldest) {
+			t.Errorf("nonce %d: oldest tracked nonce is %x, expected %d", test.nonce, oldest[len(oldest)-8:], test.oldest)
+		}
+	}
+	if sinfo.nonceIsOK(testNonce(3)) {
+		t.Error("a forgotten nonce was accepted")
+	}
+}
+
+// Checks that a flood of packets within the nonce window can't make a session
+// track more than maxTrackedNonces nonces, however big the heap size is.
+func TestNonceCapFlood(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured uint64 // NonceHeapSize in the config
+		loaded     bool   // Load the heap size from the config, rather than using it as-is
+		expected   int    // Most nonces tracked at once
+	}{
+		{"default heap size", 0, true, maxTrackedNonces},
+		{"heap size at the cap", maxTrackedNonces, true, maxTrackedNonces},
+		{"heap size over the cap", 2 * maxTrackedNonces, true, maxTrackedNonces},
+		{"heap size over the cap, not loaded", 2 * maxTrackedNonces, false, maxTrackedNonces},
+	}
+	for _, test := range tests {
+		now := time.Unix(1000000, 0)
+		sinfo := newTestSessionInfo(&now)
+		if test.loaded {
+			var isClamped bool
+			_, sinfo.nonceHeapSize, isClamped = getNonceOptions(&config.SessionOptions{NonceHeapSize: test.configured})
+			if isClamped != (test.configured > maxTrackedNonces) {
+				t.Errorf("%s: got isClamped=%v", test.name, isClamped)
+			}
+		} else {
+			sinfo.nonceHeapSize = int(test.configured)
+		}
+		// The clock never moves, so every nonce is still within the window
+		flood := uint64(4 * test.expected)
+		for n := uint64(1); n <= flood; n++ {
+			sinfo.updateNonce(testNonce(n))
+			if len(sinfo.theirNonceHeap) > test.expected || len(sinfo.theirNonceMap) > test.expected {
+				t.Fatalf("%s: tracking %d in the heap and %d in the map after nonce %d, expected at most %d",
+					test.name, len(sinfo.theirNonceHeap), len(sinfo.theirNonceMap), n, test.expected)
+			}
+		}
+		if len(sinfo.theirNonceHeap) != test.expected {
+			t.Errorf("%s: tracking %d nonces after the flood, expected %d", test.name, len(sinfo.theirNonceHeap), test.expected)
+		}
+		if oldest := sinfo.theirNonceHeap.peek(); *oldest != *testNonce(flood - uint64(test.expected) + 1) {
+			t.Errorf("%s: the oldest nonces weren't the ones forgotten", test.name)
+		}
+		if !sinfo.nonceIsOK(testNonce(flood + 1)) {
+			t.Errorf("%s: a new nonce was rejected after the flood", test.name)
+		}
+	}
+}
+
+// Checks that the session ages reported through the API go by the session clock.
+func TestSessionAge(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	sinfo := newTestSessionInfo(&now)
+	sinfo.timeOpened = now
+	sinfo.time = now
+	ss := &sinfo.core.sessions
+	ss.sinfos = map[crypto.Handle]*sessionInfo{{1}: sinfo}
+	now = now.Add(time.Minute)
+	if uptime := sinfo.getSession().Uptime; uptime != time.Minute {
+		t.Errorf("session has uptime %v, expected %v", uptime, time.Minute)
+	}
+	for _, s := range ss.getSessionStats() {
+		if s.Uptime != time.Minute || s.LastPacket != time.Minute {
+			t.Errorf("session stats have uptime %v and last packet %v, expected %v", s.Uptime, s.LastPacket, time.Minute)
+		}
+	}
+}
+
+// Checks that picking a handle that another session already has is counted as
+// a handle collision for the new session, which then gets another handle.
+func TestHandleCollision(t *testing.T) {
+	core := newTestCore(t, nil)
+	defer core.Stop()
+	taken := *crypto.NewHandle()
+	tests := []struct {
+		name       string
+		collisions int // Handles generated that are already taken, before a free one
+		failed     bool
+	}{
+		{"first session", 0, false}, // Gets the taken handle, for the rest to collide with
+		{"one collision", 1, false},
+		{"several collisions", 3, false},
+		{"only collisions", maxHandleAttempts, true},
+	}
+	for idx, test := range tests {
+		// None of these nodes exist, so the sessions stay half-open
+		theirPerm, _ := crypto.NewBoxKeys()
+		generated := 0
+		var sinfo *sessionInfo
+		var err error
+		var stats []SessionStats
+		core.router.doAdmin(func() {
+			core.sessions.newHandle = func(prefix []byte) *crypto.Handle {
+				generated++
+				if idx == 0 || generated <= test.collisions {
+					h := taken
+					return &h
+				}
+				return crypto.NewHandleWithPrefix(prefix)
+			}
+			sinfo, err = core.sessions.createSession(theirPerm, true)
+			core.sessions.newHandle = crypto.NewHandleWithPrefix
+			stats = core.sessions.getSessionStats()
+		})
+		if (err != nil) != test.failed {
+			t.Errorf("%s: got error %v, expected failed=%v", test.name, err, test.failed)
+		}
+		if err != nil {
+			continue
+		}
+		if idx > 0 && sinfo.myHandle == taken {
+			t.Errorf("%s: the session was given a handle that was already taken", test.name)
+		}
+		for _, s := range stats {
+			if s.PublicKey == *theirPerm && s.HandleCollisions != uint64(test.collisions) {
+				t.Errorf("%s: got %d handle collisions, expected %d", test.name, s.HandleCollisions, test.collisions)
+			}
+		}
+	}
+}
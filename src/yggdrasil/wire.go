@@ -23,6 +23,7 @@ const (
 	wire_DHTLookupResponse          // inside protocol traffic header
 	wire_NodeInfoRequest            // inside protocol traffic header
 	wire_NodeInfoResponse           // inside protocol traffic header
+	wire_SessionClose               // inside protocol traffic header
 )
 
 // Calls wire_put_uint64 on a nil slice.
@@ -351,6 +352,14 @@ func (p *sessionPing) encode() []byte {
 	coords := wire_encode_coords(p.Coords)
 	bs = append(bs, coords...)
 	bs = append(bs, wire_encode_uint64(uint64(p.MTU))...)
+	var flags uint64
+	if p.Compression {
+		flags |= sessionPingCompression
+	}
+	if p.TraceIDs {
+		flags |= sessionPingTraceIDs
+	}
+	bs = append(bs, wire_encode_uint64(flags)...)
 	return bs
 }
 
@@ -359,6 +368,7 @@ func (p *sessionPing) decode(bs []byte) bool {
 	var pType uint64
 	var tstamp uint64
 	var mtu uint64
+	var flags uint64
 	switch {
 	case !wire_chop_uint64(&pType, &bs):
 		return false
@@ -374,13 +384,47 @@ func (p *sessionPing) decode(bs []byte) bool {
 	case !wire_chop_coords(&p.Coords, &bs):
 		return false
 	case !wire_chop_uint64(&mtu, &bs):
-		mtu = 1280
+		mtu = minSessionMTU
+	case !wire_chop_uint64(&flags, &bs):
+		// Older nodes don't send any flags
 	}
 	p.Tstamp = wire_intFromUint(tstamp)
 	if pType == wire_SessionPong {
 		p.IsPong = true
 	}
 	p.MTU = uint16(mtu)
+	p.Compression = flags&sessionPingCompression != 0
+	p.TraceIDs = flags&sessionPingTraceIDs != 0
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Encodes a sessionClose into its wire format.
+func (p *sessionClose) encode() []byte {
+	bs := wire_encode_uint64(wire_SessionClose)
+	//p.sendPermPub used in top level (crypto), so skipped here
+	bs = append(bs, p.Handle[:]...)
+	bs = append(bs, wire_encode_uint64(wire_intToUint(p.Tstamp))...)
+	return bs
+}
+
+// Decodes an encoded sessionClose into the struct, returning true if successful.
+func (p *sessionClose) decode(bs []byte) bool {
+	var pType uint64
+	var tstamp uint64
+	switch {
+	case !wire_chop_uint64(&pType, &bs):
+		return false
+	case pType != wire_SessionClose:
+		return false
+		//p.sendPermPub used in top level (crypto), so skipped here
+	case !wire_chop_slice(p.Handle[:], &bs):
+		return false
+	case !wire_chop_uint64(&tstamp, &bs):
+		return false
+	}
+	p.Tstamp = wire_intFromUint(tstamp)
 	return true
 }
 
@@ -0,0 +1,77 @@
+package yggdrasil
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/crypto"
+)
+
+func TestSessionPingEncoding(t *testing.T) {
+	sesPub, _ := crypto.NewBoxKeys()
+	tests := []struct {
+		name string
+		ping sessionPing
+	}{
+		{"ping", sessionPing{Tstamp: 1, MTU: 1280}},
+		{"pong", sessionPing{Tstamp: 2, MTU: 65535, IsPong: true}},
+		{"coords", sessionPing{Tstamp: 3, MTU: 1280, Coords: []byte{1, 2, 3}}},
+		{"compression", sessionPing{Tstamp: 4, MTU: 1280, Compression: true}},
+		{"trace IDs", sessionPing{Tstamp: 5, MTU: 1280, TraceIDs: true}},
+		{"all flags", sessionPing{Tstamp: 6, MTU: 1280, Compression: true, TraceIDs: true}},
+	}
+	for _, test := range tests {
+		test.ping.Handle = *crypto.NewHandle()
+		test.ping.SendSesPub = *sesPub
+		var decoded sessionPing
+		if !decoded.decode(test.ping.encode()) {
+			t.Errorf("%s: failed to decode", test.name)
+			continue
+		}
+		switch {
+		case decoded.Handle != test.ping.Handle || decoded.SendSesPub != test.ping.SendSesPub:
+			t.Errorf("%s: keys didn't match", test.name)
+		case decoded.Tstamp != test.ping.Tstamp || decoded.MTU != test.ping.MTU || decoded.IsPong != test.ping.IsPong:
+			t.Errorf("%s: got %+v", test.name, decoded)
+		case !bytes.Equal(decoded.Coords, test.ping.Coords):
+			t.Errorf("%s: got coords %v, expected %v", test.name, decoded.Coords, test.ping.Coords)
+		case decoded.Compression != test.ping.Compression || decoded.TraceIDs != test.ping.TraceIDs:
+			t.Errorf("%s: got flags compression=%v trace_ids=%v", test.name, decoded.Compression, decoded.TraceIDs)
+		}
+	}
+	// Older nodes don't send the flags at all
+	ping := sessionPing{Tstamp: 7, MTU: 1280, Compression: true, TraceIDs: true}
+	bs := ping.encode()
+	var decoded sessionPing
+	if !decoded.decode(bs[:len(bs)-len(wire_encode_uint64(sessionPingCompression|sessionPingTraceIDs))]) {
+		t.Fatal("failed to decode a ping without flags")
+	}
+	if decoded.Compression || decoded.TraceIDs {
+		t.Fatal("flags were set on a ping without any")
+	}
+}
+
+func TestSessionCloseEncoding(t *testing.T) {
+	msg := sessionClose{Handle: *crypto.NewHandle(), Tstamp: 1234567890}
+	bs := msg.encode()
+	ping := sessionPing{Tstamp: 1, MTU: 1280}
+	tests := []struct {
+		name  string
+		bs    []byte
+		valid bool
+	}{
+		{"close", bs, true},
+		{"truncated handle", bs[:len(bs)-8], false},
+		{"missing tstamp", bs[:len(bs)-len(wire_encode_uint64(wire_intToUint(msg.Tstamp)))], false},
+		{"ping", ping.encode(), false},
+		{"empty", nil, false},
+	}
+	for _, test := range tests {
+		var decoded sessionClose
+		if ok := decoded.decode(test.bs); ok != test.valid {
+			t.Errorf("%s: got valid=%v, expected %v", test.name, ok, test.valid)
+		} else if ok && (decoded.Handle != msg.Handle || decoded.Tstamp != msg.Tstamp) {
+			t.Errorf("%s: got %+v, expected %+v", test.name, decoded, msg)
+		}
+	}
+}